@@ -44,6 +44,14 @@ app.kubernetes.io/version: {{ .Chart.AppVersion | quote }}
 app.kubernetes.io/managed-by: {{ .Release.Service }}
 {{- end -}}
 
+{{/*
+Version header of the configuration files
+*/}}
+{{- define "chart-env-injector.configHeader" -}}
+apiVersion: env-injector.hmcts.net/v1alpha2
+kind: EnvInjectorConfig
+{{- end }}
+
 {{/*
 Template to add the environment variable list and checking the format of the keys
 The key or "environment variable" must be uppercase and contain only numbers or "_".
@@ -59,6 +67,18 @@ The key or "environment variable" must be uppercase and contain only numbers or
   value: {{ tpl ($val | quote) $ }}
     {{- end }}
   {{- end }}
+  {{- if .Values.keyVaultEnvironment -}}
+    {{- range $key, $val := .Values.keyVaultEnvironment }}
+- name: {{ if $key | regexMatch "^[^.-]+$" -}}
+          {{- $key }}
+        {{- else -}}
+            {{- fail (join "Environment variables can not contain '.' or '-' Failed key: " ($key|quote)) -}}
+        {{- end }}
+  keyVaultRef:
+    vault: {{ required "keyVaultEnvironment entries need a vault" $val.vault | quote }}
+    secret: {{ required "keyVaultEnvironment entries need a secret" $val.secret | quote }}
+    {{- end }}
+  {{- end }}
 {{- end }}
 
 {{/*
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// serviceAccountTokenVolumePrefix starts the name of the projected volume the ServiceAccount admission plugin
+// adds to pods that automount their token, e.g. kube-api-access-6x2ld
+const serviceAccountTokenVolumePrefix = "kube-api-access-"
+
+// addAutomountServiceAccountToken performs the mutation needed to default automountServiceAccountToken
+// on the target resource, leaving any value the pod already sets untouched
+func addAutomountServiceAccountToken(target, automount *bool, basePath string) (patch []patchOperation) {
+	if target != nil || automount == nil {
+		return patch
+	}
+	patch = append(patch, patchOperation{
+		Op:    "add",
+		Path:  basePath,
+		Value: *automount,
+	})
+
+	return patch
+}
+
+// removeServiceAccountTokenVolume performs the mutation(s) needed to take the service account token back out of
+// the target resource. Mutating webhooks run after the ServiceAccount admission plugin, which has already added
+// its projected volume and mounted it into every container by the time automountServiceAccountToken is set to
+// false, so the volume and the mounts referencing it are removed too. Both are removed from pod as well.
+func removeServiceAccountTokenVolume(pod *corev1.Pod) (patch []patchOperation) {
+	for idx, vol := range pod.Spec.Volumes {
+		if !isServiceAccountTokenVolume(vol) {
+			continue
+		}
+		patch = append(patch, removeVolumeMounts(pod.Spec.InitContainers, vol.Name, "/spec/initContainers")...)
+		patch = append(patch, removeVolumeMounts(pod.Spec.Containers, vol.Name, "/spec/containers")...)
+		patch = append(patch, patchOperation{Op: "remove", Path: fmt.Sprintf("/spec/volumes/%d", idx)})
+		pod.Spec.Volumes = append(pod.Spec.Volumes[:idx:idx], pod.Spec.Volumes[idx+1:]...)
+		return patch
+	}
+	return patch
+}
+
+// isServiceAccountTokenVolume reports whether vol is the token volume of the ServiceAccount admission plugin
+func isServiceAccountTokenVolume(vol corev1.Volume) bool {
+	if !strings.HasPrefix(vol.Name, serviceAccountTokenVolumePrefix) || vol.Projected == nil {
+		return false
+	}
+	for _, source := range vol.Projected.Sources {
+		if source.ServiceAccountToken != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// removeVolumeMounts performs the mutation(s) needed to remove the mounts of the volume called name from the
+// containers at basePath, last first so the indexes of the ones left stay valid
+func removeVolumeMounts(containers []corev1.Container, name, basePath string) (patch []patchOperation) {
+	for c := range containers {
+		mounts := containers[c].VolumeMounts
+		for idx := len(mounts) - 1; idx >= 0; idx-- {
+			if mounts[idx].Name == name {
+				patch = append(patch, patchOperation{Op: "remove", Path: fmt.Sprintf("%s/%d/volumeMounts/%d", basePath, c, idx)})
+				mounts = append(mounts[:idx:idx], mounts[idx+1:]...)
+			}
+		}
+		containers[c].VolumeMounts = mounts
+	}
+	return patch
+}
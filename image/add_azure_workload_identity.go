@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	azureClientIDAnnotation        = "azure.workload.identity/client-id"
+	azureTenantIDAnnotation        = "azure.workload.identity/tenant-id"
+	azureTokenExpirationAnnotation = "azure.workload.identity/service-account-token-expiration"
+	azureSkipContainersAnnotation  = "azure.workload.identity/skip-containers"
+	azureUseLabel                  = "azure.workload.identity/use"
+
+	azureTokenVolumeName           = "azure-identity-token"
+	azureTokenMountPath            = "/var/run/secrets/azure/tokens"
+	azureTokenAudience             = "api://AzureADTokenExchange"
+	defaultAzureAuthorityHost      = "https://login.microsoftonline.com/"
+	defaultAzureTokenExpiration    = int64(3600)
+	minServiceAccountTokenLifetime = int64(600)
+)
+
+// lookupServiceAccount returns the pod's service account from the cache, or nil when it cannot be found
+func lookupServiceAccount(serviceAccounts corelisters.ServiceAccountLister, pod *corev1.Pod) *corev1.ServiceAccount {
+	if serviceAccounts == nil {
+		return nil
+	}
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	sa, err := serviceAccounts.ServiceAccounts(pod.Namespace).Get(name)
+	if err != nil {
+		glog.Warningf("Could not look up service account %s/%s: %v", pod.Namespace, name, err)
+		return nil
+	}
+	return sa
+}
+
+// azureWorkloadIdentityClientID returns the client ID the service account is federated with, or "" when the
+// pod does not use workload identity
+func azureWorkloadIdentityClientID(wi *AzureWorkloadIdentity, sa *corev1.ServiceAccount) string {
+	if wi == nil || sa == nil {
+		return ""
+	}
+	return sa.Annotations[azureClientIDAnnotation]
+}
+
+// azureWorkloadIdentityEnv returns the variables the Azure Identity SDKs read to exchange the projected token for
+// an Azure AD token. Variables the container already sets are left alone.
+func azureWorkloadIdentityEnv(wi *AzureWorkloadIdentity, sa *corev1.ServiceAccount, pod *corev1.Pod, container corev1.Container, target []corev1.EnvVar) []EnvVar {
+	clientID := azureWorkloadIdentityClientID(wi, sa)
+	if clientID == "" || azureSkipsContainer(pod, container.Name) {
+		return nil
+	}
+
+	tenantID := sa.Annotations[azureTenantIDAnnotation]
+	if tenantID == "" {
+		tenantID = wi.TenantID
+	}
+	authorityHost := wi.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = defaultAzureAuthorityHost
+	}
+
+	var envVars []EnvVar
+	for _, e := range []corev1.EnvVar{
+		{Name: "AZURE_CLIENT_ID", Value: clientID},
+		{Name: "AZURE_TENANT_ID", Value: tenantID},
+		{Name: "AZURE_FEDERATED_TOKEN_FILE", Value: path.Join(azureTokenMountPath, azureTokenVolumeName)},
+		{Name: "AZURE_AUTHORITY_HOST", Value: authorityHost},
+	} {
+		if e.Value != "" && envIndex(target, e.Name) < 0 {
+			envVars = append(envVars, EnvVar{EnvVar: e})
+		}
+	}
+	return envVars
+}
+
+// addAzureWorkloadIdentity performs the mutation(s) needed to label the target resource as using workload identity
+// and to mount a service account token for the Azure AD audience into every container and init container not
+// skipped by the pod
+func addAzureWorkloadIdentity(pod *corev1.Pod, wi *AzureWorkloadIdentity, sa *corev1.ServiceAccount) (patch []patchOperation) {
+	if azureWorkloadIdentityClientID(wi, sa) == "" {
+		return nil
+	}
+
+	expiration := wi.TokenExpirationSeconds
+	if value, ok := sa.Annotations[azureTokenExpirationAnnotation]; ok {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds < minServiceAccountTokenLifetime {
+			glog.Warningf("Ignoring %s=%q on service account %s/%s, expected at least %d seconds", azureTokenExpirationAnnotation, value, sa.Namespace, sa.Name, minServiceAccountTokenLifetime)
+		} else {
+			expiration = seconds
+		}
+	}
+	if expiration == 0 {
+		expiration = defaultAzureTokenExpiration
+	}
+
+	patch = append(patch, addLabels(pod.Labels, map[string]string{azureUseLabel: "true"}, "/metadata/labels")...)
+
+	volume := corev1.Volume{Name: azureTokenVolumeName, VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+		Sources: []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+			Audience:          azureTokenAudience,
+			ExpirationSeconds: &expiration,
+			Path:              azureTokenVolumeName,
+		}}},
+	}}}
+	patch = append(patch, addVolumes(&pod.Spec.Volumes, []corev1.Volume{volume}, "/spec/volumes")...)
+
+	mount := corev1.VolumeMount{Name: azureTokenVolumeName, MountPath: azureTokenMountPath, ReadOnly: true}
+	for idx, container := range pod.Spec.Containers {
+		if azureSkipsContainer(pod, container.Name) {
+			continue
+		}
+		patch = append(patch, addVolumeMounts(&pod.Spec.Containers[idx].VolumeMounts, []corev1.VolumeMount{mount}, fmt.Sprintf("/spec/containers/%d/volumeMounts", idx))...)
+	}
+	for idx, container := range pod.Spec.InitContainers {
+		// the Java agent's init container only copies the agent and has no use for the token
+		if container.Name == javaAgentName || azureSkipsContainer(pod, container.Name) {
+			continue
+		}
+		patch = append(patch, addVolumeMounts(&pod.Spec.InitContainers[idx].VolumeMounts, []corev1.VolumeMount{mount}, fmt.Sprintf("/spec/initContainers/%d/volumeMounts", idx))...)
+	}
+	return patch
+}
+
+// azureSkipsContainer reports whether the container is listed in the pod's semicolon separated skip-containers
+// annotation
+func azureSkipsContainer(pod *corev1.Pod, name string) bool {
+	for _, skipped := range strings.Split(pod.Annotations[azureSkipContainersAnnotation], ";") {
+		if strings.TrimSpace(skipped) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addLabels performs the mutation(s) needed to set the labels on the target resource
+func addLabels(target map[string]string, labels map[string]string, basePath string) (patch []patchOperation) {
+	if target == nil {
+		return []patchOperation{{Op: "add", Path: basePath, Value: labels}}
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value, ok := target[key]; ok && value == labels[key] {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/" + strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1"),
+			Value: labels[key],
+		})
+	}
+	return patch
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/golang/glog"
+	jsondiff "gomodules.xyz/jsonpatch/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// addCustomPatches turns the raw patches from the configuration into patch operations. Each patch is
+// evaluated against the pod as it looks once every earlier operation has been applied, so existence tests
+// and strategic merges see the result of the typed mutators.
+func addCustomPatches(original []byte, applied []patchOperation, customPatches []PodPatch) (patch []patchOperation, err error) {
+	current, err := applyPatchOperations(original, applied)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply typed mutations before custom patches: %w", err)
+	}
+
+	for i, custom := range customPatches {
+		if custom.Test != nil {
+			exists, err := jsonPointerExists(current, custom.Test.Path)
+			if err != nil {
+				glog.Warningf("Skipping patch %d: %v", i, err)
+				continue
+			}
+			if exists != custom.Test.Exists {
+				continue
+			}
+		}
+
+		var ops []patchOperation
+		if custom.StrategicMerge != nil {
+			ops, err = strategicMergeSpec(current, custom.StrategicMerge)
+			if err != nil {
+				glog.Warningf("Skipping patch %d: %v", i, err)
+				continue
+			}
+		} else {
+			ops = []patchOperation{{Op: custom.Op, Path: custom.Path, Value: custom.Value, From: custom.From}}
+		}
+
+		// a patch that does not fit this pod, e.g. removing a field it never set, is skipped rather than
+		// denying the pod, as an item whose when expression fails is
+		next, err := applyPatchOperations(current, ops)
+		if err != nil {
+			glog.Warningf("Skipping patch %d, it could not be applied: %v", i, err)
+			continue
+		}
+		current = next
+		patch = append(patch, ops...)
+	}
+	return patch, nil
+}
+
+// applyPatchOperations applies the patch operations to the JSON document and returns the result
+func applyPatchOperations(doc []byte, ops []patchOperation) ([]byte, error) {
+	if len(ops) == 0 {
+		return doc, nil
+	}
+	opsJSON, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := jsonpatch.DecodePatch(opsJSON)
+	if err != nil {
+		return nil, err
+	}
+	return decoded.Apply(doc)
+}
+
+// strategicMergeSpec merges the fragment into the pod spec and returns the operations that turn the current
+// spec into the merged one
+func strategicMergeSpec(podJSON []byte, fragment map[string]interface{}) ([]patchOperation, error) {
+	var pod struct {
+		Spec json.RawMessage `json:"spec"`
+	}
+	if err := json.Unmarshal(podJSON, &pod); err != nil {
+		return nil, err
+	}
+	fragmentJSON, err := json.Marshal(fragment)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := strategicpatch.StrategicMergePatch(pod.Spec, fragmentJSON, corev1.PodSpec{})
+	if err != nil {
+		return nil, fmt.Errorf("strategic merge failed: %w", err)
+	}
+	diff, err := jsondiff.CreatePatch(pod.Spec, merged)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []patchOperation
+	for _, d := range diff {
+		ops = append(ops, patchOperation{Op: d.Operation, Path: "/spec" + d.Path, Value: d.Value})
+	}
+	return ops, nil
+}
+
+// jsonPointerExists reports whether the RFC 6901 pointer resolves to a non null value in the JSON document
+func jsonPointerExists(doc []byte, pointer string) (bool, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return false, err
+	}
+
+	var node interface{}
+	if err := json.Unmarshal(doc, &node); err != nil {
+		return false, err
+	}
+	for _, token := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[token]
+		case []interface{}:
+			idx, err := strconv.Atoi(token)
+			if err != nil || idx < 0 || idx >= len(n) {
+				return false, nil
+			}
+			node = n[idx]
+		default:
+			return false, nil
+		}
+		if node == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// parseJSONPointer returns the unescaped reference tokens of the RFC 6901 pointer, none for the whole document
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q, it must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] == '~' && (j+1 == len(token) || (token[j+1] != '0' && token[j+1] != '1')) {
+				return nil, fmt.Errorf("invalid JSON pointer %q, ~ must be escaped as ~0", pointer)
+			}
+		}
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// patchOps are the operations of RFC 6902
+var patchOps = []string{"add", "remove", "replace", "copy", "move", "test"}
+
+// validatePodPatch checks the patch at p is either a strategic merge or a well formed RFC 6902 operation, so a
+// mistake is caught when the configuration is loaded rather than failing the admission of every pod
+func validatePodPatch(p string, patch PodPatch) (errs []error) {
+	if patch.Test != nil {
+		if _, err := parseJSONPointer(patch.Test.Path); err != nil {
+			errs = append(errs, configErrorf(p+".test.path", "%v", err))
+		}
+	}
+	if patch.StrategicMerge != nil {
+		if patch.Op != "" || patch.Path != "" || patch.From != "" || patch.Value != nil {
+			errs = append(errs, configErrorf(p, "strategicMerge cannot be combined with op, path, from or value"))
+		}
+		errs = append(errs, keyedListFields(p+".strategicMerge", patch.StrategicMerge, reflect.TypeOf(corev1.PodSpec{}))...)
+		return errs
+	}
+
+	if !slices.Contains(patchOps, patch.Op) {
+		errs = append(errs, configErrorf(p+".op", "unknown op %q, expected one of %s", patch.Op, strings.Join(patchOps, ", ")))
+	}
+	if patch.Path == "" {
+		errs = append(errs, configErrorf(p+".path", "is required"))
+	} else if _, err := parseJSONPointer(patch.Path); err != nil {
+		errs = append(errs, configErrorf(p+".path", "%v", err))
+	}
+	switch {
+	case patch.Op == "copy" || patch.Op == "move":
+		if patch.From == "" {
+			errs = append(errs, configErrorf(p+".from", "is required for %s", patch.Op))
+		} else if _, err := parseJSONPointer(patch.From); err != nil {
+			errs = append(errs, configErrorf(p+".from", "%v", err))
+		}
+	case patch.From != "":
+		errs = append(errs, configErrorf(p+".from", "is only used by copy and move"))
+	}
+	return errs
+}
+
+// keyedListFields reports the lists in the strategic merge fragment that are merged by a key, such as containers
+// by name. An element whose key matches nothing in the pod is added as a new element, so a fragment meant to
+// change the app container would give a pod without one an extra, image-less container and fail its admission.
+func keyedListFields(p string, fragment map[string]interface{}, t reflect.Type) (errs []error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	keys := make([]string, 0, len(fragment))
+	for key := range fragment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		field, ok := jsonField(t, key)
+		if !ok {
+			continue
+		}
+		switch value := fragment[key].(type) {
+		case []interface{}:
+			if mergeKey := field.Tag.Get("patchMergeKey"); mergeKey != "" {
+				errs = append(errs, configErrorf(p+"."+key, "is merged by %s and would add elements to pods that do not match, use an op patch instead", mergeKey))
+			}
+		case map[string]interface{}:
+			errs = append(errs, keyedListFields(p+"."+key, value, field.Type)...)
+		}
+	}
+	return errs
+}
+
+// jsonField returns the field of the struct that is serialised under the JSON name
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if tagName, _, _ := strings.Cut(field.Tag.Get("json"), ","); tagName == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
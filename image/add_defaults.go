@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// serverDefaultedPaths are the pod fields the API server defaults before admission webhooks run, so a default
+// for one of them would never apply
+var serverDefaultedPaths = []string{
+	"spec.dnsPolicy",
+	"spec.enableServiceLinks",
+	"spec.restartPolicy",
+	"spec.schedulerName",
+	"spec.securityContext",
+	"spec.terminationGracePeriodSeconds",
+}
+
+// addDefaults performs the mutation(s) needed to set each configured field on the target resource, but only
+// when the pod leaves it unset. Fields are keyed by a dotted path from the pod root, e.g. spec.setHostnameAsFQDN,
+// and any missing parent objects are created along the way. A path that does not fit the pod is logged and skipped.
+func addDefaults(original []byte, applied []patchOperation, defaults map[string]interface{}) (patch []patchOperation, err error) {
+	current, err := applyPatchOperations(original, applied)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply typed mutations before defaults: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(current, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(defaults))
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		segments, err := defaultPathSegments(key)
+		if err != nil {
+			glog.Warningf("Skipping default: %v", err)
+			continue
+		}
+		node := doc
+		path := ""
+		for i, segment := range segments {
+			path += "/" + strings.ReplaceAll(strings.ReplaceAll(segment, "~", "~0"), "/", "~1")
+			child, ok := node[segment]
+			if !ok || child == nil {
+				patch = append(patch, patchOperation{
+					Op:    "add",
+					Path:  path,
+					Value: nestDefault(segments[i+1:], defaults[key]),
+				})
+				// keep our view of the pod in step so later paths sharing a parent are added into it
+				node[segment] = nestDefault(segments[i+1:], defaults[key])
+				break
+			}
+			if i == len(segments)-1 {
+				break
+			}
+			childMap, ok := child.(map[string]interface{})
+			if !ok {
+				glog.Warningf("Skipping default %q, %s is not an object", key, path)
+				break
+			}
+			node = childMap
+		}
+	}
+	return patch, nil
+}
+
+// defaultPathSegments splits the dotted path of a default into its fields, which must be under the pod's
+// metadata or spec
+func defaultPathSegments(key string) ([]string, error) {
+	segments := strings.Split(key, ".")
+	if slices.Contains(segments, "") {
+		return nil, fmt.Errorf("invalid default path %q", key)
+	}
+	if len(segments) < 2 || (segments[0] != "metadata" && segments[0] != "spec") {
+		return nil, fmt.Errorf("default path %q must be a field under metadata or spec", key)
+	}
+	return segments, nil
+}
+
+// nestDefault wraps value in one object per remaining path segment
+func nestDefault(segments []string, value interface{}) interface{} {
+	for i := len(segments) - 1; i >= 0; i-- {
+		value = map[string]interface{}{segments[i]: value}
+	}
+	return value
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// downwardEnv expands the downward API shorthand into the environment variables for a container. Pod fields
+// (metadata., spec. and status.) become fieldRefs, while container resources (limits. and requests.) become
+// resourceFieldRefs for the named container.
+func downwardEnv(downward map[string]string, containerName string) []EnvVar {
+	names := make([]string, 0, len(downward))
+	for name := range downward {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	envVars := make([]EnvVar, 0, len(names))
+	for _, name := range names {
+		ref := downward[name]
+		source := &corev1.EnvVarSource{}
+		if isResourceFieldRef(ref) {
+			source.ResourceFieldRef = &corev1.ResourceFieldSelector{ContainerName: containerName, Resource: ref}
+		} else {
+			source.FieldRef = &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: ref}
+		}
+		envVars = append(envVars, EnvVar{EnvVar: corev1.EnvVar{Name: name, ValueFrom: source}})
+	}
+	return envVars
+}
+
+// isResourceFieldRef reports whether the downward API reference is to a container resource rather than a pod field
+func isResourceFieldRef(ref string) bool {
+	return strings.HasPrefix(ref, "limits.") || strings.HasPrefix(ref, "requests.")
+}
+
+// downwardFieldPaths are the pod fields the downward API can expose as environment variables. Labels and
+// annotations are only available one key at a time, as metadata.labels['key'].
+var downwardFieldPaths = map[string]bool{
+	"metadata.name":           true,
+	"metadata.namespace":      true,
+	"metadata.uid":            true,
+	"spec.nodeName":           true,
+	"spec.serviceAccountName": true,
+	"status.hostIP":           true,
+	"status.hostIPs":          true,
+	"status.podIP":            true,
+	"status.podIPs":           true,
+}
+
+// downwardResources are the container resources the downward API can expose, besides hugepages-<size>
+var downwardResources = map[string]bool{"cpu": true, "memory": true, "ephemeral-storage": true}
+
+// validateDownward checks each downward API reference is to a pod field or container resource the downward API
+// supports for environment variables
+func validateDownward(downward map[string]string) (errs []error) {
+	names := make([]string, 0, len(downward))
+	for name := range downward {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ref := downward[name]
+		for _, msg := range validation.IsEnvVarName(name) {
+			errs = append(errs, configErrorf("downward."+name, "invalid name %q: %s", name, msg))
+		}
+		if err := validateDownwardRef(ref); err != nil {
+			errs = append(errs, configErrorf("downward."+name, "%q %v", ref, err))
+		}
+	}
+	return errs
+}
+
+// validateDownwardRef returns why the downward API cannot expose ref as an environment variable, if it cannot
+func validateDownwardRef(ref string) error {
+	if isResourceFieldRef(ref) {
+		_, resource, _ := strings.Cut(ref, ".")
+		if !downwardResources[resource] && !strings.HasPrefix(resource, corev1.ResourceHugePagesPrefix) {
+			return errors.New("is not a container resource the downward API supports (cpu, memory, ephemeral-storage, hugepages-<size>)")
+		}
+		return nil
+	}
+	for _, prefix := range []string{"metadata.labels", "metadata.annotations"} {
+		if rest, ok := strings.CutPrefix(ref, prefix); ok && rest != "" {
+			key, opened := strings.CutPrefix(rest, "['")
+			key, closed := strings.CutSuffix(key, "']")
+			if !opened || !closed || len(validation.IsQualifiedName(key)) > 0 {
+				return fmt.Errorf("must be %s['<key>'] with a valid key", prefix)
+			}
+			return nil
+		}
+	}
+	if !downwardFieldPaths[ref] {
+		return errors.New("is neither a pod field the downward API supports for environment variables (metadata.name, metadata.namespace, " +
+			"metadata.uid, metadata.labels['<key>'], metadata.annotations['<key>'], spec.nodeName, spec.serviceAccountName, status.hostIP, " +
+			"status.hostIPs, status.podIP, status.podIPs) nor a container resource (limits.<resource>, requests.<resource>)")
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
 	"github.com/google/go-cmp/cmp"
 	corev1 "k8s.io/api/core/v1"
 )
@@ -43,9 +47,145 @@ func addEnv(target, envVars []corev1.EnvVar, basePath string) (patch []patchOper
 				Path:  path,
 				Value: value,
 			})
-		} else {
+		} else if patch == nil {
+			// keep the operations for earlier variables when this one is already set
 			patch = []patchOperation{}
 		}
 	}
 	return patch
 }
+
+// mergeEnvValues resolves the injection mode of each environment variable against the target resource,
+// returning the variables addEnv should set. Appended and prepended values are joined onto the value the
+// container already sets, unless it already holds them. Several entries for the same variable build on each
+// other and are returned as one.
+func mergeEnvValues(target []corev1.EnvVar, envVars []EnvVar) []corev1.EnvVar {
+	current := append([]corev1.EnvVar{}, target...)
+	merged := make([]corev1.EnvVar, 0, len(envVars))
+	for _, envVar := range envVars {
+		resolved := resolveEnvValue(current, envVar)
+		if idx := envIndex(merged, resolved.Name); idx >= 0 {
+			merged[idx] = resolved
+		} else {
+			merged = append(merged, resolved)
+		}
+		if idx := envIndex(current, resolved.Name); idx >= 0 {
+			current[idx] = resolved
+		} else {
+			current = append(current, resolved)
+		}
+	}
+	return merged
+}
+
+// resolveEnvValue applies the injection mode of envVar to the value it has in target
+func resolveEnvValue(target []corev1.EnvVar, envVar EnvVar) corev1.EnvVar {
+	if envVar.Mode == "" || envVar.Mode == envModeReplace {
+		return envVar.EnvVar
+	}
+
+	existing := envIndex(target, envVar.Name)
+	if existing < 0 || (target[existing].Value == "" && target[existing].ValueFrom == nil) {
+		return envVar.EnvVar
+	}
+	if target[existing].ValueFrom != nil || envVar.ValueFrom != nil {
+		glog.Warningf("Cannot %s %s when either value comes from valueFrom, leaving it unchanged", envVar.Mode, envVar.Name)
+		return target[existing]
+	}
+
+	separator := envVar.Separator
+	if separator == "" {
+		separator = " "
+	}
+	value := target[existing].Value
+	for _, part := range strings.Split(value, separator) {
+		if part == envVar.Value {
+			return target[existing]
+		}
+	}
+	if envVar.Mode == envModeAppend {
+		value = value + separator + envVar.Value
+	} else {
+		value = envVar.Value + separator + value
+	}
+	return corev1.EnvVar{Name: envVar.Name, Value: value}
+}
+
+// insertEnv performs the mutation(s) needed to insert the environment variables that are new to the target
+// resource at their first or auto position, so variables defined earlier in the list can be referenced as
+// $(NAME). It returns the target as it looks once the insertions are applied, along with the variables left
+// for addEnv to append or replace.
+func insertEnv(target []corev1.EnvVar, envVars []EnvVar, basePath string) (updated []corev1.EnvVar, patch []patchOperation, remaining []EnvVar) {
+	updated = append([]corev1.EnvVar{}, target...)
+	var auto []EnvVar
+	next := 0
+	for _, envVar := range envVars {
+		if (envVar.Position != envPositionFirst && envVar.Position != envPositionAuto) || envIndex(updated, envVar.Name) >= 0 {
+			remaining = append(remaining, envVar)
+			continue
+		}
+		if envVar.Position == envPositionAuto {
+			auto = append(auto, envVar)
+			continue
+		}
+		patch = append(patch, insertEnvAt(&updated, len(target) == 0 && len(patch) == 0, next, envVar.EnvVar, basePath))
+		next++
+	}
+
+	for _, envVar := range auto {
+		idx := -1
+		for i, targetOpt := range updated {
+			if referencesEnv(targetOpt.Value, envVar.Name) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			// nothing references it so it can go last like any other variable
+			remaining = append(remaining, envVar)
+			continue
+		}
+		patch = append(patch, insertEnvAt(&updated, false, idx, envVar.EnvVar, basePath))
+	}
+	return updated, patch, remaining
+}
+
+// insertEnvAt inserts envVar into target at idx, returning the matching patch operation. The env list itself is
+// added when the container has none.
+func insertEnvAt(target *[]corev1.EnvVar, create bool, idx int, envVar corev1.EnvVar, basePath string) patchOperation {
+	*target = append((*target)[:idx], append([]corev1.EnvVar{envVar}, (*target)[idx:]...)...)
+	if create {
+		return patchOperation{Op: "add", Path: basePath, Value: []corev1.EnvVar{envVar}}
+	}
+	return patchOperation{Op: "add", Path: fmt.Sprintf("%s/%d", basePath, idx), Value: envVar}
+}
+
+// envIndex returns the index of the environment variable called name in target, or -1
+func envIndex(target []corev1.EnvVar, name string) int {
+	for idx, targetOpt := range target {
+		if targetOpt.Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+// referencesEnv reports whether value refers to the variable name with $(name), ignoring escaped $$(name)
+func referencesEnv(value, name string) bool {
+	ref := "$(" + name + ")"
+	for offset := 0; ; {
+		idx := strings.Index(value[offset:], ref)
+		if idx < 0 {
+			return false
+		}
+		idx += offset
+		dollars := 0
+		for i := idx - 1; i >= 0 && value[i] == '$'; i-- {
+			dollars++
+		}
+		if dollars%2 == 0 {
+			return true
+		}
+		offset = idx + len(ref)
+	}
+}
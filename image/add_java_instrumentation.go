@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	javaAgentName             = "env-injector-java-agent"
+	javaAgentJar              = "agent.jar"
+	defaultJavaAgentMountPath = "/env-injector/java-agent"
+)
+
+// javaAgentMountPath returns where the shared volume holding the agent jar is mounted
+func javaAgentMountPath(java *JavaInstrumentation) string {
+	if java.MountPath != "" {
+		return java.MountPath
+	}
+	return defaultJavaAgentMountPath
+}
+
+// javaAgentResources returns the requests and limits of the init container that copies the agent jar. Without
+// resources it would fail to start in namespaces whose ResourceQuota requires them, and copying a jar needs
+// little, so the default is small.
+func javaAgentResources(java *JavaInstrumentation) corev1.ResourceRequirements {
+	if java.Resources != nil {
+		return *java.Resources
+	}
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m"), corev1.ResourceMemory: resource.MustParse("32Mi")},
+		Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+	}
+}
+
+// javaAgentSecurityContext returns the security context of the init container that copies the agent jar, which
+// meets the restricted Pod Security Standard so the init container does not get pods rejected in namespaces that
+// enforce it
+func javaAgentSecurityContext() *corev1.SecurityContext {
+	allowPrivilegeEscalation, runAsNonRoot := false, true
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		RunAsNonRoot:             &runAsNonRoot,
+		SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}
+}
+
+// javaAgentEnv returns the environment variables that load the agent in the container, if it is instrumented
+func javaAgentEnv(java *JavaInstrumentation, container corev1.Container) []EnvVar {
+	if java == nil || !imageMatches(container.Image, java.Images) {
+		return nil
+	}
+	return []EnvVar{{
+		EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-javaagent:" + path.Join(javaAgentMountPath(java), javaAgentJar)},
+		Mode:   envModeAppend,
+	}}
+}
+
+// addJavaInstrumentation performs the mutation(s) needed to give the instrumented containers of the target
+// resource the Java agent: an emptyDir volume, an init container that copies the agent jar from its image into
+// the volume and a mount of the volume in each instrumented container
+func addJavaInstrumentation(pod *corev1.Pod, java *JavaInstrumentation) (patch []patchOperation) {
+	var instrumented []int
+	for idx, container := range pod.Spec.Containers {
+		if imageMatches(container.Image, java.Images) {
+			instrumented = append(instrumented, idx)
+		}
+	}
+	if len(instrumented) == 0 {
+		return patch
+	}
+
+	mountPath := javaAgentMountPath(java)
+	mount := corev1.VolumeMount{Name: javaAgentName, MountPath: mountPath}
+	patch = append(patch, addVolumes(&pod.Spec.Volumes, []corev1.Volume{{
+		Name:         javaAgentName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	}}, "/spec/volumes")...)
+	patch = append(patch, addInitContainers(&pod.Spec.InitContainers, []corev1.Container{{
+		Name:            javaAgentName,
+		Image:           java.Image,
+		Command:         []string{"cp", java.AgentPath, path.Join(mountPath, javaAgentJar)},
+		Resources:       javaAgentResources(java),
+		VolumeMounts:    []corev1.VolumeMount{mount},
+		SecurityContext: javaAgentSecurityContext(),
+	}}, "/spec/initContainers")...)
+	for _, idx := range instrumented {
+		patch = append(patch, addVolumeMounts(&pod.Spec.Containers[idx].VolumeMounts, []corev1.VolumeMount{mount}, fmt.Sprintf("/spec/containers/%d/volumeMounts", idx))...)
+	}
+	return patch
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	secretsStoreDriver         = "secrets-store.csi.k8s.io"
+	keyVaultNamePrefix         = "keyvault-"
+	keyVaultMountPathPrefix    = "/mnt/secrets-store"
+	secretProviderClassAttrKey = "secretProviderClass"
+)
+
+var (
+	keyVaultNamePattern   = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]{1,22}[a-zA-Z0-9]$`)
+	keyVaultSecretPattern = regexp.MustCompile(`^[a-zA-Z0-9-]{1,127}$`)
+)
+
+// keyVaultObjectName returns the name shared by the SecretProviderClass for the vault, the Kubernetes Secret it
+// syncs and the CSI volume mounting it
+func keyVaultObjectName(vault string) string {
+	return keyVaultNamePrefix + strings.ToLower(vault)
+}
+
+// resolveKeyVaultRefs rewrites env entries that take their value from Key Vault into secretKeyRefs to the synced
+// Kubernetes Secret, and returns the vaults whose CSI volumes the pod must mount for that Secret to exist
+func resolveKeyVaultRefs(env []EnvVar) ([]EnvVar, []string) {
+	var vaults []string
+	seen := map[string]bool{}
+	resolved := make([]EnvVar, 0, len(env))
+	for _, e := range env {
+		if e.KeyVaultRef != nil {
+			name := keyVaultObjectName(e.KeyVaultRef.Vault)
+			e.ValueFrom = &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Key:                  e.KeyVaultRef.Secret,
+			}}
+			e.KeyVaultRef = nil
+			if !seen[name] {
+				seen[name] = true
+				vaults = append(vaults, name)
+			}
+		}
+		resolved = append(resolved, e)
+	}
+	sort.Strings(vaults)
+	return resolved, vaults
+}
+
+// addKeyVaultVolumes performs the mutation(s) needed to mount the Secrets Store CSI volume for each vault into
+// every container of the target resource. The driver only syncs a SecretProviderClass to its Kubernetes Secret
+// while some pod mounts it, so the mount is what keeps the secretKeyRefs resolvable.
+func addKeyVaultVolumes(pod *corev1.Pod, vaults []string) (patch []patchOperation) {
+	readOnly := true
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	for _, name := range vaults {
+		volumes = append(volumes, corev1.Volume{Name: name, VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{
+			Driver:           secretsStoreDriver,
+			ReadOnly:         &readOnly,
+			VolumeAttributes: map[string]string{secretProviderClassAttrKey: name},
+		}}})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: path.Join(keyVaultMountPathPrefix, strings.TrimPrefix(name, keyVaultNamePrefix)), ReadOnly: true})
+	}
+
+	patch = append(patch, addVolumes(&pod.Spec.Volumes, volumes, "/spec/volumes")...)
+	for idx := range pod.Spec.Containers {
+		patch = append(patch, addVolumeMounts(&pod.Spec.Containers[idx].VolumeMounts, mounts, fmt.Sprintf("/spec/containers/%d/volumeMounts", idx))...)
+	}
+	return patch
+}
+
+// validateKeyVaultRef checks that the env entry at path p can take its value from Key Vault
+func validateKeyVaultRef(p string, e EnvVar) (errs []error) {
+	ref := e.KeyVaultRef
+	if !keyVaultNamePattern.MatchString(ref.Vault) {
+		errs = append(errs, configErrorf(p+".keyVaultRef.vault", "invalid key vault name %q", ref.Vault))
+	}
+	if !keyVaultSecretPattern.MatchString(ref.Secret) {
+		errs = append(errs, configErrorf(p+".keyVaultRef.secret", "invalid key vault secret name %q", ref.Secret))
+	}
+	if e.Value != "" || e.ValueFrom != nil {
+		errs = append(errs, configErrorf(p+".keyVaultRef", "cannot be combined with value or valueFrom"))
+	}
+	if e.Mode != "" && e.Mode != envModeReplace {
+		errs = append(errs, configErrorf(p+".mode", "keyVaultRef values cannot be %sed", e.Mode))
+	}
+	return errs
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	otelPodNameEnv  = "OTEL_K8S_POD_NAME"
+	otelNodeNameEnv = "OTEL_K8S_NODE_NAME"
+)
+
+var defaultOtelServiceNameLabels = []string{"app.kubernetes.io/name", "app"}
+
+// otelEnv returns the OpenTelemetry environment variables for a container. OTEL_SERVICE_NAME is only set when
+// the container leaves it unset, and the resource attributes are merged into any the container sets, keeping
+// its own value for attributes both define. The pod and node names come from the downward API as they are not
+// always known at admission time.
+func otelEnv(otel *OpenTelemetry, pod *corev1.Pod, container corev1.Container, target []corev1.EnvVar) []EnvVar {
+	if otel == nil {
+		return nil
+	}
+
+	var envVars []EnvVar
+	if envIndex(target, "OTEL_SERVICE_NAME") < 0 {
+		if serviceName := otelServiceName(otel, pod); serviceName != "" {
+			envVars = append(envVars, EnvVar{EnvVar: corev1.EnvVar{Name: "OTEL_SERVICE_NAME", Value: serviceName}})
+		}
+	}
+
+	existing := envIndex(target, "OTEL_RESOURCE_ATTRIBUTES")
+	if existing >= 0 && target[existing].ValueFrom != nil {
+		return envVars
+	}
+	var attributes []string
+	if existing >= 0 && target[existing].Value != "" {
+		attributes = strings.Split(target[existing].Value, ",")
+	}
+	set := map[string]bool{}
+	for _, attribute := range attributes {
+		set[strings.TrimSpace(strings.SplitN(attribute, "=", 2)[0])] = true
+	}
+	addAttribute := func(key, value string) {
+		if !set[key] && value != "" {
+			set[key] = true
+			attributes = append(attributes, key+"="+value)
+		}
+	}
+	addAttribute("k8s.namespace.name", pod.Namespace)
+	addAttribute("k8s.pod.name", "$("+otelPodNameEnv+")")
+	addAttribute("k8s.container.name", container.Name)
+	addAttribute("k8s.node.name", "$("+otelNodeNameEnv+")")
+	addAttribute("k8s.cluster.name", otel.ClusterName)
+	keys := make([]string, 0, len(otel.ResourceAttributes))
+	for key := range otel.ResourceAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		addAttribute(key, otel.ResourceAttributes[key])
+	}
+
+	// the downward API variables must come before the attributes that reference them
+	envVars = append(envVars,
+		EnvVar{EnvVar: corev1.EnvVar{Name: otelPodNameEnv, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.name"}}}, Position: envPositionFirst},
+		EnvVar{EnvVar: corev1.EnvVar{Name: otelNodeNameEnv, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "spec.nodeName"}}}, Position: envPositionFirst},
+		EnvVar{EnvVar: corev1.EnvVar{Name: "OTEL_RESOURCE_ATTRIBUTES", Value: strings.Join(attributes, ",")}},
+	)
+	return envVars
+}
+
+// otelServiceName returns the first of the configured labels set on the pod, falling back to the name of the
+// pod's owner, without the pod template hash a Deployment adds to its ReplicaSets
+func otelServiceName(otel *OpenTelemetry, pod *corev1.Pod) string {
+	labels := otel.ServiceNameLabels
+	if len(labels) == 0 {
+		labels = defaultOtelServiceNameLabels
+	}
+	for _, label := range labels {
+		if value := pod.Labels[label]; value != "" {
+			return value
+		}
+	}
+
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller != nil && *owner.Controller {
+			if hash := pod.Labels["pod-template-hash"]; owner.Kind == "ReplicaSet" && hash != "" {
+				return strings.TrimSuffix(owner.Name, "-"+hash)
+			}
+			return owner.Name
+		}
+	}
+	return ""
+}
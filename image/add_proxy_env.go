@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// proxyEnv returns the proxy environment variables for a container, in both the upper and lower case spelling
+// as tools disagree on which one they read. A proxy the container already sets in either spelling is kept and
+// copied to the other. NO_PROXY is the container's own list followed by the in cluster exclusions, so
+// Services are reached directly however they are addressed.
+func proxyEnv(proxy *Proxy, pod *corev1.Pod, target []corev1.EnvVar) []EnvVar {
+	if proxy == nil {
+		return nil
+	}
+
+	var envVars []EnvVar
+	for _, p := range []struct{ name, value string }{{"HTTP_PROXY", proxy.HTTPProxy}, {"HTTPS_PROXY", proxy.HTTPSProxy}} {
+		value, ok := proxyEnvValue(target, p.name)
+		if !ok {
+			continue
+		}
+		if value == "" {
+			value = p.value
+		}
+		envVars = append(envVars, proxyEnvPair(target, p.name, value)...)
+	}
+
+	existing, ok := proxyEnvValue(target, "NO_PROXY")
+	if !ok {
+		return envVars
+	}
+	noProxy := append([]string{}, strings.Split(existing, ",")...)
+	noProxy = append(noProxy, "localhost", "127.0.0.1")
+	noProxy = append(noProxy, proxy.ClusterCIDRs...)
+	noProxy = append(noProxy, ".svc", ".cluster.local")
+	if pod.Namespace != "" {
+		noProxy = append(noProxy, "."+pod.Namespace)
+	}
+	noProxy = append(noProxy, proxy.NoProxy...)
+
+	seen := map[string]bool{}
+	var entries []string
+	for _, entry := range noProxy {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	return append(envVars, proxyEnvPair(target, "NO_PROXY", strings.Join(entries, ","))...)
+}
+
+// proxyEnvValue returns the value the container sets for the variable, preferring the upper case spelling. It
+// reports false when either spelling comes from valueFrom, as the webhook cannot see or merge that value.
+func proxyEnvValue(target []corev1.EnvVar, name string) (string, bool) {
+	var value string
+	for _, spelling := range []string{strings.ToLower(name), name} {
+		if idx := envIndex(target, spelling); idx >= 0 {
+			if target[idx].ValueFrom != nil {
+				return "", false
+			}
+			if target[idx].Value != "" {
+				value = target[idx].Value
+			}
+		}
+	}
+	return value, true
+}
+
+// proxyEnvPair returns the variables needed to set both spellings of name to value, skipping those already set
+// to it
+func proxyEnvPair(target []corev1.EnvVar, name, value string) []EnvVar {
+	if value == "" {
+		return nil
+	}
+	var envVars []EnvVar
+	for _, spelling := range []string{name, strings.ToLower(name)} {
+		if idx := envIndex(target, spelling); idx < 0 || target[idx].Value != value {
+			envVars = append(envVars, EnvVar{EnvVar: corev1.EnvVar{Name: spelling, Value: value}})
+		}
+	}
+	return envVars
+}
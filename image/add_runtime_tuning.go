@@ -0,0 +1,69 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// runtimeTuningEnv returns the environment variables that size a container's runtime to its CPU and memory
+// limits, using the first rule whose images match the container. Settings the container already makes are
+// left alone, as is any setting whose limit is not set.
+func runtimeTuningEnv(rules []RuntimeTuningRule, container corev1.Container, target []corev1.EnvVar) []EnvVar {
+	var rule *RuntimeTuningRule
+	for i := range rules {
+		if imageMatches(container.Image, rules[i].Images) {
+			rule = &rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return nil
+	}
+
+	var envVars []EnvVar
+	cpu, hasCPU := container.Resources.Limits[corev1.ResourceCPU]
+	memory, hasMemory := container.Resources.Limits[corev1.ResourceMemory]
+
+	if rule.GoMaxProcs && hasCPU && envIndex(target, "GOMAXPROCS") < 0 {
+		procs := (cpu.MilliValue() + 999) / 1000
+		if procs < 1 {
+			procs = 1
+		}
+		envVars = append(envVars, EnvVar{EnvVar: corev1.EnvVar{Name: "GOMAXPROCS", Value: strconv.FormatInt(procs, 10)}})
+	}
+	if rule.JavaMaxRAMPercentage > 0 && hasMemory && !envContains(target, "JAVA_TOOL_OPTIONS", "MaxRAMPercentage") {
+		envVars = append(envVars, EnvVar{
+			EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:MaxRAMPercentage=" + strconv.FormatFloat(rule.JavaMaxRAMPercentage, 'f', 1, 64)},
+			Mode:   envModeAppend,
+		})
+	}
+	if rule.NodeMaxOldSpacePercentage > 0 && hasMemory && !envContains(target, "NODE_OPTIONS", "--max-old-space-size") {
+		mebibytes := memory.Value() / (1024 * 1024) * int64(rule.NodeMaxOldSpacePercentage) / 100
+		envVars = append(envVars, EnvVar{
+			EnvVar: corev1.EnvVar{Name: "NODE_OPTIONS", Value: "--max-old-space-size=" + strconv.FormatInt(mebibytes, 10)},
+			Mode:   envModeAppend,
+		})
+	}
+	return envVars
+}
+
+// envContains reports whether the variable called name in target has a value containing substr
+func envContains(target []corev1.EnvVar, name, substr string) bool {
+	idx := envIndex(target, name)
+	return idx >= 0 && strings.Contains(target[idx].Value, substr)
+}
+
+// imageMatches reports whether the image matches any of the patterns, where * matches any run of characters
+// including /
+func imageMatches(image string, patterns []string) bool {
+	for _, pattern := range patterns {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if matched, _ := regexp.MatchString(expr, image); matched {
+			return true
+		}
+	}
+	return false
+}
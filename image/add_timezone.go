@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	timezoneVolumeName = "env-injector-localtime"
+	localtimePath      = "/etc/localtime"
+)
+
+// timezoneEnv returns TZ for a container that does not already set it
+func timezoneEnv(tz *Timezone, target []corev1.EnvVar) []EnvVar {
+	if tz == nil || envIndex(target, "TZ") >= 0 {
+		return nil
+	}
+	return []EnvVar{{EnvVar: corev1.EnvVar{Name: "TZ", Value: tz.Name}}}
+}
+
+// addTimezone performs the mutation(s) needed to mount the zoneinfo file for the timezone at /etc/localtime in
+// every container of the target resource. Containers that already mount something there are left alone.
+func addTimezone(pod *corev1.Pod, tz *Timezone) (patch []patchOperation) {
+	volume := corev1.Volume{Name: timezoneVolumeName}
+	mount := corev1.VolumeMount{Name: timezoneVolumeName, MountPath: localtimePath, ReadOnly: true}
+	switch {
+	case tz.ConfigMap != "":
+		key := tz.Key
+		if key == "" {
+			key = strings.ReplaceAll(tz.Name, "/", "_")
+		}
+		volume.ConfigMap = &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: tz.ConfigMap},
+			Items:                []corev1.KeyToPath{{Key: key, Path: "localtime"}},
+		}
+		mount.SubPath = "localtime"
+	case tz.HostPath != "":
+		fileType := corev1.HostPathFile
+		volume.HostPath = &corev1.HostPathVolumeSource{Path: path.Join(tz.HostPath, tz.Name), Type: &fileType}
+	default:
+		return nil
+	}
+
+	patch = append(patch, addVolumes(&pod.Spec.Volumes, []corev1.Volume{volume}, "/spec/volumes")...)
+	for idx := range pod.Spec.Containers {
+		patch = append(patch, addVolumeMounts(&pod.Spec.Containers[idx].VolumeMounts, []corev1.VolumeMount{mount}, fmt.Sprintf("/spec/containers/%d/volumeMounts", idx))...)
+	}
+	return patch
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	trustBundleVolumeName       = "env-injector-trust-bundle"
+	defaultTrustBundleKey       = "ca.crt"
+	defaultTrustBundleMountPath = "/etc/env-injector/trust-bundle"
+)
+
+// trustBundleMountPath returns the directory the bundle is mounted at
+func trustBundleMountPath(tb *TrustBundle) string {
+	if tb.MountPath != "" {
+		return tb.MountPath
+	}
+	return defaultTrustBundleMountPath
+}
+
+// trustBundleEnv returns the environment variables that point OpenSSL, Node.js, Python requests and, when a
+// trust store is configured, Java at the bundle. Variables the container already sets are left alone. Only
+// NODE_EXTRA_CA_CERTS adds to the default roots, the others replace them.
+func trustBundleEnv(tb *TrustBundle, target []corev1.EnvVar) []EnvVar {
+	if tb == nil {
+		return nil
+	}
+
+	key := tb.Key
+	if key == "" {
+		key = defaultTrustBundleKey
+	}
+	bundle := path.Join(trustBundleMountPath(tb), key)
+
+	var envVars []EnvVar
+	for _, name := range []string{"SSL_CERT_FILE", "NODE_EXTRA_CA_CERTS", "REQUESTS_CA_BUNDLE"} {
+		if envIndex(target, name) < 0 {
+			envVars = append(envVars, EnvVar{EnvVar: corev1.EnvVar{Name: name, Value: bundle}})
+		}
+	}
+	if tb.JavaTrustStoreKey != "" && !envContains(target, "JAVA_TOOL_OPTIONS", "javax.net.ssl.trustStore") {
+		opts := fmt.Sprintf("-Djavax.net.ssl.trustStore=%s -Djavax.net.ssl.trustStoreType=PKCS12", path.Join(trustBundleMountPath(tb), tb.JavaTrustStoreKey))
+		if tb.JavaTrustStorePassword != "" {
+			opts += " -Djavax.net.ssl.trustStorePassword=" + tb.JavaTrustStorePassword
+		}
+		envVars = append(envVars, EnvVar{EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: opts}, Mode: envModeAppend})
+	}
+	return envVars
+}
+
+// addTrustBundle performs the mutation(s) needed to mount the ConfigMap or Secret holding the CA bundle read only
+// into every container of the target resource
+func addTrustBundle(pod *corev1.Pod, tb *TrustBundle) (patch []patchOperation) {
+	volume := corev1.Volume{Name: trustBundleVolumeName}
+	if tb.Secret != "" {
+		volume.Secret = &corev1.SecretVolumeSource{SecretName: tb.Secret}
+	} else {
+		volume.ConfigMap = &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: tb.ConfigMap}}
+	}
+	patch = append(patch, addVolumes(&pod.Spec.Volumes, []corev1.Volume{volume}, "/spec/volumes")...)
+
+	mount := corev1.VolumeMount{Name: trustBundleVolumeName, MountPath: trustBundleMountPath(tb), ReadOnly: true}
+	for idx := range pod.Spec.Containers {
+		patch = append(patch, addVolumeMounts(&pod.Spec.Containers[idx].VolumeMounts, []corev1.VolumeMount{mount}, fmt.Sprintf("/spec/containers/%d/volumeMounts", idx))...)
+	}
+	return patch
+}
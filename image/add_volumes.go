@@ -0,0 +1,69 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addVolumes performs the mutation(s) needed to add the volumes to the target resource. Volumes whose name is
+// already taken are skipped, so a pod's own volume always wins. The added volumes are appended to target, so the
+// next feature adding volumes to the same list appends to them rather than replacing the list.
+func addVolumes(target *[]corev1.Volume, volumes []corev1.Volume, basePath string) (patch []patchOperation) {
+	names := map[string]bool{}
+	for _, targetOpt := range *target {
+		names[targetOpt.Name] = true
+	}
+	for _, vol := range volumes {
+		if names[vol.Name] {
+			continue
+		}
+		names[vol.Name] = true
+		patch = append(patch, appendPatch(len(*target) == 0, basePath, vol, []corev1.Volume{vol}))
+		*target = append(*target, vol)
+	}
+	return patch
+}
+
+// addVolumeMounts performs the mutation(s) needed to add the volume mounts to the target container. Mounts
+// whose path is already in use are skipped. The added mounts are appended to target.
+func addVolumeMounts(target *[]corev1.VolumeMount, mounts []corev1.VolumeMount, basePath string) (patch []patchOperation) {
+	paths := map[string]bool{}
+	for _, targetOpt := range *target {
+		paths[targetOpt.MountPath] = true
+	}
+	for _, mount := range mounts {
+		if paths[mount.MountPath] {
+			continue
+		}
+		paths[mount.MountPath] = true
+		patch = append(patch, appendPatch(len(*target) == 0, basePath, mount, []corev1.VolumeMount{mount}))
+		*target = append(*target, mount)
+	}
+	return patch
+}
+
+// addInitContainers performs the mutation(s) needed to add the init containers to the target resource,
+// skipping any whose name is already taken. The added containers are appended to target.
+func addInitContainers(target *[]corev1.Container, containers []corev1.Container, basePath string) (patch []patchOperation) {
+	names := map[string]bool{}
+	for _, targetOpt := range *target {
+		names[targetOpt.Name] = true
+	}
+	for _, container := range containers {
+		if names[container.Name] {
+			continue
+		}
+		names[container.Name] = true
+		patch = append(patch, appendPatch(len(*target) == 0, basePath, container, []corev1.Container{container}))
+		*target = append(*target, container)
+	}
+	return patch
+}
+
+// appendPatch returns the operation that appends value to the list at basePath, creating the list holding
+// list when it does not exist yet
+func appendPatch(create bool, basePath string, value, list interface{}) patchOperation {
+	if create {
+		return patchOperation{Op: "add", Path: basePath, Value: list}
+	}
+	return patchOperation{Op: "add", Path: basePath + "/-", Value: value}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/cel-go/cel"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// conditionCostLimit bounds the runtime cost of a `when` expression, as the API server does for the CEL of
+	// admission policies, so one expression cannot hold up pod creation
+	conditionCostLimit = 1000000
+	// conditionInterruptCheckFrequency is how many comprehension iterations pass between checks of
+	// conditionEvalTimeout
+	conditionInterruptCheckFrequency = 100
+	// conditionEvalTimeout bounds the time a `when` expression can take
+	conditionEvalTimeout = 100 * time.Millisecond
+)
+
+var conditionEnv *cel.Env
+
+// conditionPrograms caches the compiled `when` expressions of the configurations in use, see retainConditions
+var conditionPrograms = struct {
+	sync.RWMutex
+	programs map[string]cel.Program
+}{programs: map[string]cel.Program{}}
+
+func init() {
+	var err error
+	conditionEnv, err = cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("namespaceObject", cel.DynType),
+		cel.Variable("request", cel.DynType),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("could not create CEL environment: %v", err))
+	}
+}
+
+// conditional is implemented by configuration items that carry a `when` expression
+type conditional[T any] interface {
+	unwrap() (item T, when string)
+}
+
+// env vars stay wrapped as their injection options are applied per container
+func (e EnvVar) unwrap() (EnvVar, string) {
+	return e, e.When
+}
+
+func (t Toleration) unwrap() (corev1.Toleration, string) {
+	return t.Toleration, t.When
+}
+
+func (n NodeSelectorTerm) unwrap() (corev1.NodeSelectorTerm, string) {
+	return n.NodeSelectorTerm, n.When
+}
+
+func (p PreferredSchedulingTerm) unwrap() (corev1.PreferredSchedulingTerm, string) {
+	return p.PreferredSchedulingTerm, p.When
+}
+
+func (t TopologySpreadConstraint) unwrap() (corev1.TopologySpreadConstraint, string) {
+	return t.TopologySpreadConstraint, t.When
+}
+
+// compileCondition compiles a `when` expression, caching the program for later requests
+func compileCondition(expr string) (cel.Program, error) {
+	conditionPrograms.RLock()
+	prg, ok := conditionPrograms.programs[expr]
+	conditionPrograms.RUnlock()
+	if ok {
+		return prg, nil
+	}
+
+	ast, issues := conditionEnv.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid when expression %q: %w", expr, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("when expression %q must evaluate to a bool, not %v", expr, ast.OutputType())
+	}
+	prg, err := conditionEnv.Program(ast, cel.CostLimit(conditionCostLimit), cel.InterruptCheckFrequency(conditionInterruptCheckFrequency))
+	if err != nil {
+		return nil, fmt.Errorf("invalid when expression %q: %w", expr, err)
+	}
+
+	conditionPrograms.Lock()
+	conditionPrograms.programs[expr] = prg
+	conditionPrograms.Unlock()
+	return prg, nil
+}
+
+// retainConditions drops the cached programs of expressions that none of the configurations in use has, so the
+// cache does not grow with every edit of a configuration, policy or override
+func retainConditions(configs ...*Config) {
+	live := map[string]bool{}
+	for _, cfg := range configs {
+		if cfg != nil {
+			forEachCondition(cfg, func(_, expr string) { live[expr] = true })
+		}
+	}
+
+	conditionPrograms.Lock()
+	defer conditionPrograms.Unlock()
+	for expr := range conditionPrograms.programs {
+		if !live[expr] {
+			delete(conditionPrograms.programs, expr)
+		}
+	}
+}
+
+// validateConditions compiles every `when` expression in the configuration so mistakes surface on load
+func validateConditions(cfg *Config) (errs []error) {
+	forEachCondition(cfg, func(path, expr string) {
+		if _, err := compileCondition(expr); err != nil {
+			errs = append(errs, configErrorf(path+".when", "%v", err))
+		}
+	})
+	return errs
+}
+
+// forEachCondition calls fn with the path and expression of every item in the configuration with a `when`
+func forEachCondition(cfg *Config, fn func(path, expr string)) {
+	check := func(path, expr string) {
+		if expr != "" {
+			fn(path, expr)
+		}
+	}
+	for i, e := range cfg.Env {
+		check(fmt.Sprintf("env[%d]", i), e.When)
+	}
+	for i, t := range cfg.Tolerations {
+		check(fmt.Sprintf("tolerations[%d]", i), t.When)
+	}
+	for i, n := range cfg.RequiredNodeAffinityTerms {
+		check(fmt.Sprintf("requiredNodeAffinityTerms[%d]", i), n.When)
+	}
+	for i, p := range cfg.PreferredNodeAffinityTerms {
+		check(fmt.Sprintf("preferredNodeAffinityTerms[%d]", i), p.When)
+	}
+	for i, t := range cfg.TopologyConstraints {
+		check(fmt.Sprintf("topologyConstraints[%d]", i), t.When)
+	}
+}
+
+// evaluateCondition reports whether the `when` expression holds for the request. An empty expression always
+// holds, while one that fails to evaluate (e.g. a missing label) or runs over conditionCostLimit or
+// conditionEvalTimeout is treated as not matching.
+func evaluateCondition(expr string, vars map[string]interface{}) bool {
+	if expr == "" {
+		return true
+	}
+	prg, err := compileCondition(expr)
+	if err != nil {
+		glog.Errorf("Skipping item: %v", err)
+		return false
+	}
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	for _, name := range []string{"object", "namespaceObject", "request"} {
+		if _, ok := vars[name]; !ok {
+			vars[name] = nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conditionEvalTimeout)
+	defer cancel()
+	out, _, err := prg.ContextEval(ctx, vars)
+	if err != nil {
+		glog.Warningf("Skipping item, when expression %q could not be evaluated: %v", expr, err)
+		return false
+	}
+	matched, ok := out.Value().(bool)
+	if !ok {
+		glog.Warningf("Skipping item, when expression %q returned %v rather than a bool", expr, out.Value())
+		return false
+	}
+	return matched
+}
+
+// selectWhen returns the items whose `when` expression holds for the request
+func selectWhen[T any, W conditional[T]](items []W, vars map[string]interface{}) []T {
+	var selected []T
+	for _, w := range items {
+		item, when := w.unwrap()
+		if evaluateCondition(when, vars) {
+			selected = append(selected, item)
+		}
+	}
+	return selected
+}
+
+// conditionVariables builds the variables `when` expressions are evaluated against: the pod as `object`, its
+// namespace as `namespaceObject` (null when it cannot be looked up) and the admission `request`
+func conditionVariables(req *v1.AdmissionRequest, pod *corev1.Pod, namespaces corelisters.NamespaceLister) (map[string]interface{}, error) {
+	object, err := toUnstructured(pod)
+	if err != nil {
+		return nil, err
+	}
+	userInfo, err := toUnstructured(req.UserInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaceObject interface{}
+	if namespaces != nil {
+		ns, err := namespaces.Get(req.Namespace)
+		if err != nil {
+			glog.Warningf("Could not look up namespace %s for when conditions: %v", req.Namespace, err)
+		} else if namespaceObject, err = toUnstructured(ns); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		"object":          object,
+		"namespaceObject": namespaceObject,
+		"request": map[string]interface{}{
+			"namespace": req.Namespace,
+			"name":      req.Name,
+			"operation": string(req.Operation),
+			"userInfo":  userInfo,
+		},
+	}, nil
+}
+
+// toUnstructured converts obj into the generic map form CEL expressions work on
+func toUnstructured(obj interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,159 @@
+// Package v1alpha2 holds the env-injector.hmcts.net/v1alpha2 layout of the configuration file, v1alpha1 with the
+// resources of the Java agent init container. The types are frozen like those of v1alpha1.
+package v1alpha2
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	APIVersion = "env-injector.hmcts.net/v1alpha2"
+	Kind       = "EnvInjectorConfig"
+)
+
+// EnvInjectorConfig is a configuration file with the fields of Config at the top
+type EnvInjectorConfig struct {
+	metav1.TypeMeta `yaml:",inline" json:",inline"`
+	Config          `yaml:",inline" json:",inline"`
+}
+
+// LayeredEnvInjectorConfig is a configuration file with a base and overlays
+type LayeredEnvInjectorConfig struct {
+	metav1.TypeMeta `yaml:",inline" json:",inline"`
+	LayeredConfig   `yaml:",inline" json:",inline"`
+}
+
+// LayeredConfig is the base configuration shared by several clusters, and the overlays layered on top of it for
+// each cluster by name
+type LayeredConfig struct {
+	Base     Config             `yaml:"base" json:"base"`
+	Overlays map[string]*Config `yaml:"overlays,omitempty" json:"overlays,omitempty"`
+}
+
+// Config is the v1alpha2 configuration. Each field means what the field of the same name on the webhook's own
+// Config does.
+type Config struct {
+	Env                          []EnvVar                    `yaml:"env" json:"env"`
+	RemoveEnv                    []string                    `yaml:"removeEnv,omitempty" json:"removeEnv,omitempty"`
+	Downward                     map[string]string           `yaml:"downward,omitempty" json:"downward,omitempty"`
+	RuntimeTuning                []RuntimeTuningRule         `yaml:"runtimeTuning,omitempty" json:"runtimeTuning,omitempty"`
+	Instrumentation              Instrumentation             `yaml:"instrumentation,omitempty" json:"instrumentation,omitempty"`
+	OTel                         *OpenTelemetry              `yaml:"otel,omitempty" json:"otel,omitempty"`
+	TrustBundle                  *TrustBundle                `yaml:"trustBundle,omitempty" json:"trustBundle,omitempty"`
+	Proxy                        *Proxy                      `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	Timezone                     *Timezone                   `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	AzureWorkloadIdentity        *AzureWorkloadIdentity      `yaml:"azureWorkloadIdentity,omitempty" json:"azureWorkloadIdentity,omitempty"`
+	DnsOptions                   []corev1.PodDNSConfigOption `yaml:"dnsOptions,omitempty" json:"dnsOptions,omitempty"`
+	RequiredNodeAffinityTerms    []NodeSelectorTerm          `yaml:"requiredNodeAffinityTerms,omitempty" json:"requiredNodeAffinityTerms,omitempty"`
+	PreferredNodeAffinityTerms   []PreferredSchedulingTerm   `yaml:"preferredNodeAffinityTerms,omitempty" json:"preferredNodeAffinityTerms,omitempty"`
+	Tolerations                  []Toleration                `yaml:"tolerations,omitempty" json:"tolerations,omitempty"`
+	TopologyConstraints          []TopologySpreadConstraint  `yaml:"topologyConstraints,omitempty" json:"topologyConstraints,omitempty"`
+	RemovePodAntiAffinity        bool                        `yaml:"removePodAntiAffinity,omitempty" json:"removePodAntiAffinity,omitempty"`
+	AutomountServiceAccountToken *bool                       `yaml:"automountServiceAccountToken,omitempty" json:"automountServiceAccountToken,omitempty"`
+	Defaults                     map[string]interface{}      `yaml:"defaults,omitempty" json:"defaults,omitempty"`
+	Patches                      []PodPatch                  `yaml:"patches,omitempty" json:"patches,omitempty"`
+	AllowedOverrides             []string                    `yaml:"allowedOverrides,omitempty" json:"allowedOverrides,omitempty"`
+}
+
+type EnvVar struct {
+	corev1.EnvVar `yaml:",inline"`
+	When          string       `yaml:"when,omitempty" json:"when,omitempty"`
+	Mode          string       `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Separator     string       `yaml:"separator,omitempty" json:"separator,omitempty"`
+	Position      string       `yaml:"position,omitempty" json:"position,omitempty"`
+	KeyVaultRef   *KeyVaultRef `yaml:"keyVaultRef,omitempty" json:"keyVaultRef,omitempty"`
+}
+
+type KeyVaultRef struct {
+	Vault  string `yaml:"vault" json:"vault"`
+	Secret string `yaml:"secret" json:"secret"`
+}
+
+type Toleration struct {
+	corev1.Toleration `yaml:",inline"`
+	When              string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+type NodeSelectorTerm struct {
+	corev1.NodeSelectorTerm `yaml:",inline"`
+	When                    string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+type PreferredSchedulingTerm struct {
+	corev1.PreferredSchedulingTerm `yaml:",inline"`
+	When                           string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+type TopologySpreadConstraint struct {
+	corev1.TopologySpreadConstraint `yaml:",inline"`
+	When                            string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+type RuntimeTuningRule struct {
+	Images                    []string `yaml:"images" json:"images"`
+	GoMaxProcs                bool     `yaml:"goMaxProcs,omitempty" json:"goMaxProcs,omitempty"`
+	JavaMaxRAMPercentage      float64  `yaml:"javaMaxRAMPercentage,omitempty" json:"javaMaxRAMPercentage,omitempty"`
+	NodeMaxOldSpacePercentage int      `yaml:"nodeMaxOldSpacePercentage,omitempty" json:"nodeMaxOldSpacePercentage,omitempty"`
+}
+
+type Instrumentation struct {
+	Java *JavaInstrumentation `yaml:"java,omitempty" json:"java,omitempty"`
+}
+
+type JavaInstrumentation struct {
+	Image     string                       `yaml:"image" json:"image"`
+	AgentPath string                       `yaml:"agentPath" json:"agentPath"`
+	Images    []string                     `yaml:"images" json:"images"`
+	MountPath string                       `yaml:"mountPath,omitempty" json:"mountPath,omitempty"`
+	Resources *corev1.ResourceRequirements `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+type OpenTelemetry struct {
+	ServiceNameLabels  []string          `yaml:"serviceNameLabels,omitempty" json:"serviceNameLabels,omitempty"`
+	ClusterName        string            `yaml:"clusterName,omitempty" json:"clusterName,omitempty"`
+	ResourceAttributes map[string]string `yaml:"resourceAttributes,omitempty" json:"resourceAttributes,omitempty"`
+}
+
+type TrustBundle struct {
+	ConfigMap              string `yaml:"configMap,omitempty" json:"configMap,omitempty"`
+	Secret                 string `yaml:"secret,omitempty" json:"secret,omitempty"`
+	Key                    string `yaml:"key,omitempty" json:"key,omitempty"`
+	MountPath              string `yaml:"mountPath,omitempty" json:"mountPath,omitempty"`
+	JavaTrustStoreKey      string `yaml:"javaTrustStoreKey,omitempty" json:"javaTrustStoreKey,omitempty"`
+	JavaTrustStorePassword string `yaml:"javaTrustStorePassword,omitempty" json:"javaTrustStorePassword,omitempty"`
+}
+
+type Proxy struct {
+	HTTPProxy    string   `yaml:"httpProxy,omitempty" json:"httpProxy,omitempty"`
+	HTTPSProxy   string   `yaml:"httpsProxy,omitempty" json:"httpsProxy,omitempty"`
+	ClusterCIDRs []string `yaml:"clusterCIDRs,omitempty" json:"clusterCIDRs,omitempty"`
+	NoProxy      []string `yaml:"noProxy,omitempty" json:"noProxy,omitempty"`
+}
+
+type Timezone struct {
+	Name      string `yaml:"name" json:"name"`
+	ConfigMap string `yaml:"configMap,omitempty" json:"configMap,omitempty"`
+	Key       string `yaml:"key,omitempty" json:"key,omitempty"`
+	HostPath  string `yaml:"hostPath,omitempty" json:"hostPath,omitempty"`
+}
+
+type AzureWorkloadIdentity struct {
+	TenantID               string `yaml:"tenantId,omitempty" json:"tenantId,omitempty"`
+	AuthorityHost          string `yaml:"authorityHost,omitempty" json:"authorityHost,omitempty"`
+	TokenExpirationSeconds int64  `yaml:"tokenExpirationSeconds,omitempty" json:"tokenExpirationSeconds,omitempty"`
+}
+
+type PodPatch struct {
+	Op             string                 `yaml:"op,omitempty" json:"op,omitempty"`
+	Path           string                 `yaml:"path,omitempty" json:"path,omitempty"`
+	From           string                 `yaml:"from,omitempty" json:"from,omitempty"`
+	Value          interface{}            `yaml:"value,omitempty" json:"value,omitempty"`
+	StrategicMerge map[string]interface{} `yaml:"strategicMerge,omitempty" json:"strategicMerge,omitempty"`
+	Test           *PatchTest             `yaml:"test,omitempty" json:"test,omitempty"`
+}
+
+type PatchTest struct {
+	Path   string `yaml:"path" json:"path"`
+	Exists bool   `yaml:"exists" json:"exists"`
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// configPublicKeyEnv holds the PEM encoded public key itself when -configPublicKey is not set, so it can be
+	// set in the Deployment rather than read from a volume the editors of the configuration could write to
+	configPublicKeyEnv = "CONFIG_PUBLIC_KEY"
+	// configSignatureSuffix is appended to the name of a configuration file to find its detached signature
+	configSignatureSuffix = ".sig"
+	// configManifestSignature is the detached signature of the manifest of a configuration directory
+	configManifestSignature = "SHA256SUMS" + configSignatureSuffix
+)
+
+// loadConfigPublicKey reads the PEM encoded public key the configuration files must be signed with: an ed25519
+// key, or the ECDSA key of a cosign key pair (cosign.pub)
+func loadConfigPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigPublicKey(file, data)
+}
+
+// parseConfigPublicKey parses the PEM encoded public key read from source
+func parseConfigPublicKey(source string, data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: no PEM encoded PUBLIC KEY", source)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported %T, expected an ed25519 or ECDSA public key", source, key)
+	}
+}
+
+// verifyConfigSignature checks sig, the detached signature of the configuration data, against key. The signature
+// is either base64 encoded, as `cosign sign-blob --output-signature` writes it, or raw. ed25519 signs the data
+// itself, while cosign signs its sha256 digest with ECDSA.
+func verifyConfigSignature(key crypto.PublicKey, data, sig []byte) error {
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig))); err == nil {
+		sig = decoded
+	}
+	var verified bool
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		verified = ed25519.Verify(key, data, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		verified = ecdsa.VerifyASN1(key, digest[:], sig)
+	}
+	if !verified {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// configManifest lists the sha256 digest and name of each file of a configuration directory, in the format of
+// sha256sum and in the order given, so that `LC_ALL=C sha256sum *.yaml` in the directory writes the same manifest.
+// Signing the manifest rather than each file means that removing, adding or swapping in a file is detected too.
+func configManifest(names []string, contents [][]byte) []byte {
+	var manifest bytes.Buffer
+	for i, name := range names {
+		fmt.Fprintf(&manifest, "%x  %s\n", sha256.Sum256(contents[i]), name)
+	}
+	return manifest.Bytes()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	yamlv3 "gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s-env-injector/config/v1alpha1"
+	"k8s-env-injector/config/v1alpha2"
+)
+
+const (
+	configKind = v1alpha2.Kind
+
+	configAPIVersionV1alpha1 = v1alpha1.APIVersion
+	configAPIVersionV1alpha2 = v1alpha2.APIVersion
+)
+
+// configVersions decodes the configuration files of each apiVersion, converting them to the Config the webhook
+// mutates with. Files without an apiVersion have the flat layout that predates versioning, which v1alpha1 keeps.
+// When the layout changes, the new version is added here with its own types, and older versions stay readable
+// by converting them.
+var configVersions = map[string]func(file string, data []byte, cluster string) (*Config, error){
+	"":                       decodeConfigV1alpha1,
+	configAPIVersionV1alpha1: decodeConfigV1alpha1,
+	configAPIVersionV1alpha2: decodeConfigV1alpha2,
+}
+
+// validateTypeMeta checks the apiVersion and kind at the top of a configuration file
+func validateTypeMeta(meta metav1.TypeMeta) (errs []error) {
+	switch {
+	case meta.APIVersion == "" && meta.Kind != "":
+		errs = append(errs, configErrorf("apiVersion", "is required with kind"))
+	case meta.APIVersion != "" && meta.Kind != configKind:
+		errs = append(errs, configErrorf("kind", "must be %s", configKind))
+	}
+	return errs
+}
+
+// decodeConfigFile decodes the configuration held in file in the layout of its apiVersion and converts it to
+// Config, taking the overlay for cluster when it is layered
+func decodeConfigFile(file string, data []byte, cluster string) (*Config, error) {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	var apiVersion string
+	if len(root.Content) > 0 {
+		if value, _ := yamlMapValue(root.Content[0], "apiVersion"); value != nil {
+			apiVersion = value.Value
+		}
+	}
+
+	decode, ok := configVersions[apiVersion]
+	if !ok {
+		versions := make([]string, 0, len(configVersions))
+		for version := range configVersions {
+			if version != "" {
+				versions = append(versions, version)
+			}
+		}
+		sort.Strings(versions)
+		return nil, fmt.Errorf("%s:%d: %w", file, configLine(&root, "apiVersion"), configErrorf("apiVersion", "unsupported version %q, expected one of %v", apiVersion, versions))
+	}
+	if apiVersion == "" {
+		glog.V(2).Infof("%s has no apiVersion, reading it as %s", file, configAPIVersionV1alpha1)
+	}
+	return decode(file, data, cluster)
+}
+
+// decodeConfig decodes a configuration that is not layered, such as the spec of a policy or a team override, in
+// the layout of its apiVersion
+func decodeConfig(file string, data []byte) (*Config, error) {
+	if isLayeredConfig(data) {
+		var root yamlv3.Node
+		_ = yamlv3.Unmarshal(data, &root)
+		key := "base"
+		if value, _ := yamlMapValue(root.Content[0], key); value == nil {
+			key = "overlays"
+		}
+		return nil, fmt.Errorf("%s:%d: %w", file, configLine(&root, key), configErrorf(key, "can only be used in the configuration file"))
+	}
+	return decodeConfigFile(file, data, "")
+}
+
+// decodeConfigV1alpha1 decodes an env-injector.hmcts.net/v1alpha1, or unversioned, configuration file
+func decodeConfigV1alpha1(file string, data []byte, cluster string) (*Config, error) {
+	if isLayeredConfig(data) {
+		var in v1alpha1.LayeredEnvInjectorConfig
+		var layered *LayeredConfig
+		if err := decodeStrict(file, data, &in, func() []error {
+			layered = convertLayeredFromV1alpha1(&in.LayeredConfig)
+			return append(validateTypeMeta(in.TypeMeta), layered.validate(cluster)...)
+		}); err != nil {
+			return nil, err
+		}
+		return layered.configFor(file, cluster), nil
+	}
+
+	var in v1alpha1.EnvInjectorConfig
+	var cfg *Config
+	if err := decodeStrict(file, data, &in, func() []error {
+		cfg = convertFromV1alpha1(&in.Config)
+		return append(validateTypeMeta(in.TypeMeta), unwrapErrors(validateConfig(cfg))...)
+	}); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decodeConfigV1alpha2 decodes an env-injector.hmcts.net/v1alpha2 configuration file
+func decodeConfigV1alpha2(file string, data []byte, cluster string) (*Config, error) {
+	if isLayeredConfig(data) {
+		var in v1alpha2.LayeredEnvInjectorConfig
+		var layered *LayeredConfig
+		if err := decodeStrict(file, data, &in, func() []error {
+			layered = convertLayeredFromV1alpha2(&in.LayeredConfig)
+			return append(validateTypeMeta(in.TypeMeta), layered.validate(cluster)...)
+		}); err != nil {
+			return nil, err
+		}
+		return layered.configFor(file, cluster), nil
+	}
+
+	var in v1alpha2.EnvInjectorConfig
+	var cfg *Config
+	if err := decodeStrict(file, data, &in, func() []error {
+		cfg = convertFromV1alpha2(&in.Config)
+		return append(validateTypeMeta(in.TypeMeta), unwrapErrors(validateConfig(cfg))...)
+	}); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
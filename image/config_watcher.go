@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// config returns the configuration requests are currently mutated with
+func (whsvr *WebhookServer) config() *Config {
+	whsvr.mu.RLock()
+	defer whsvr.mu.RUnlock()
+	return whsvr.envConfig
+}
+
+// retainConditions keeps the cached `when` programs of the configuration file, the policies and the team
+// overrides, and drops the rest
+func (whsvr *WebhookServer) retainConditions() {
+	configs := []*Config{whsvr.config()}
+	if whsvr.policies != nil {
+		configs = append(configs, whsvr.policies.configs()...)
+	}
+	if whsvr.overrides != nil {
+		configs = append(configs, whsvr.overrides.configs()...)
+	}
+	retainConditions(configs...)
+}
+
+// reloadConfig loads configFile and swaps it in when its content changed. An invalid configuration is returned
+// as an error, once per content, and the current configuration is kept.
+func (whsvr *WebhookServer) reloadConfig(configFile string) error {
+	cfg, sum, err := loadConfig(configFile, whsvr.cluster, whsvr.configKey)
+
+	// deferred first to run once the lock is released, as it reads the configuration
+	defer whsvr.retainConditions()
+	whsvr.mu.Lock()
+	defer whsvr.mu.Unlock()
+	var zero [len(sum)]byte
+	if sum == whsvr.envConfigSum && whsvr.envConfig != nil {
+		whsvr.rejectedSum = zero
+		return nil
+	}
+	if err != nil {
+		if sum != zero && sum == whsvr.rejectedSum {
+			return nil
+		}
+		whsvr.rejectedSum = sum
+		return err
+	}
+
+	if whsvr.envConfig == nil {
+		glog.Infof("Loaded configuration %s: sha256sum %x", configFile, sum)
+	} else {
+		glog.Infof("Reloaded configuration %s: sha256sum %x -> %x", configFile, whsvr.envConfigSum, sum)
+	}
+	glog.Infof("Configuration data: %+v", cfg)
+	whsvr.envConfig, whsvr.envConfigSum = cfg, sum
+	return nil
+}
+
+// watchConfig reloads the configuration whenever configFile, or a file in it when it is a directory, changes,
+// until stopCh is closed. The directory is watched rather than the file, as a mounted ConfigMap is updated by
+// swapping the ..data symlink, which replaces the file without writing to it.
+func (whsvr *WebhookServer) watchConfig(configFile string, stopCh <-chan struct{}) error {
+	dir := filepath.Dir(configFile)
+	if info, err := os.Stat(configFile); err == nil && info.IsDir() {
+		dir = configFile
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// other files in the directory change too, reloading unchanged content is a no-op
+				if err := whsvr.reloadConfig(configFile); err != nil {
+					glog.Errorf("Keeping the current configuration: %v", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Warningf("Error watching %s: %v", configFile, err)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"k8s-env-injector/config/v1alpha1"
+)
+
+// convertFromV1alpha1 converts a v1alpha1 configuration to Config. Each field is converted explicitly, so a field
+// added to Config is left out of v1alpha1 until a new version takes it.
+func convertFromV1alpha1(in *v1alpha1.Config) *Config {
+	out := &Config{
+		Env:                          convertSlice(in.Env, convertEnvVarFromV1alpha1),
+		RemoveEnv:                    in.RemoveEnv,
+		Downward:                     in.Downward,
+		DnsOptions:                   in.DnsOptions,
+		RemovePodAntiAffinity:        in.RemovePodAntiAffinity,
+		AutomountServiceAccountToken: in.AutomountServiceAccountToken,
+		Defaults:                     in.Defaults,
+		Patches:                      convertSlice(in.Patches, convertPodPatchFromV1alpha1),
+		AllowedOverrides:             in.AllowedOverrides,
+	}
+	// the item types have the same fields in both, which the conversions check at compile time
+	out.RuntimeTuning = convertSlice(in.RuntimeTuning, func(r v1alpha1.RuntimeTuningRule) RuntimeTuningRule { return RuntimeTuningRule(r) })
+	out.RequiredNodeAffinityTerms = convertSlice(in.RequiredNodeAffinityTerms, func(t v1alpha1.NodeSelectorTerm) NodeSelectorTerm { return NodeSelectorTerm(t) })
+	out.PreferredNodeAffinityTerms = convertSlice(in.PreferredNodeAffinityTerms, func(t v1alpha1.PreferredSchedulingTerm) PreferredSchedulingTerm { return PreferredSchedulingTerm(t) })
+	out.Tolerations = convertSlice(in.Tolerations, func(t v1alpha1.Toleration) Toleration { return Toleration(t) })
+	out.TopologyConstraints = convertSlice(in.TopologyConstraints, func(c v1alpha1.TopologySpreadConstraint) TopologySpreadConstraint { return TopologySpreadConstraint(c) })
+	if java := in.Instrumentation.Java; java != nil {
+		out.Instrumentation.Java = &JavaInstrumentation{Image: java.Image, AgentPath: java.AgentPath, Images: java.Images, MountPath: java.MountPath}
+	}
+	if otel := in.OTel; otel != nil {
+		out.OTel = &OpenTelemetry{ServiceNameLabels: otel.ServiceNameLabels, ClusterName: otel.ClusterName, ResourceAttributes: otel.ResourceAttributes}
+	}
+	if tb := in.TrustBundle; tb != nil {
+		out.TrustBundle = &TrustBundle{ConfigMap: tb.ConfigMap, Secret: tb.Secret, Key: tb.Key, MountPath: tb.MountPath,
+			JavaTrustStoreKey: tb.JavaTrustStoreKey, JavaTrustStorePassword: tb.JavaTrustStorePassword}
+	}
+	if proxy := in.Proxy; proxy != nil {
+		out.Proxy = &Proxy{HTTPProxy: proxy.HTTPProxy, HTTPSProxy: proxy.HTTPSProxy, ClusterCIDRs: proxy.ClusterCIDRs, NoProxy: proxy.NoProxy}
+	}
+	if tz := in.Timezone; tz != nil {
+		out.Timezone = &Timezone{Name: tz.Name, ConfigMap: tz.ConfigMap, Key: tz.Key, HostPath: tz.HostPath}
+	}
+	if wi := in.AzureWorkloadIdentity; wi != nil {
+		out.AzureWorkloadIdentity = &AzureWorkloadIdentity{TenantID: wi.TenantID, AuthorityHost: wi.AuthorityHost, TokenExpirationSeconds: wi.TokenExpirationSeconds}
+	}
+	return out
+}
+
+func convertEnvVarFromV1alpha1(in v1alpha1.EnvVar) EnvVar {
+	out := EnvVar{EnvVar: in.EnvVar, When: in.When, Mode: in.Mode, Separator: in.Separator, Position: in.Position}
+	if in.KeyVaultRef != nil {
+		out.KeyVaultRef = &KeyVaultRef{Vault: in.KeyVaultRef.Vault, Secret: in.KeyVaultRef.Secret}
+	}
+	return out
+}
+
+func convertPodPatchFromV1alpha1(in v1alpha1.PodPatch) PodPatch {
+	out := PodPatch{Op: in.Op, Path: in.Path, From: in.From, Value: in.Value, StrategicMerge: in.StrategicMerge}
+	if in.Test != nil {
+		out.Test = &PatchTest{Path: in.Test.Path, Exists: in.Test.Exists}
+	}
+	return out
+}
+
+// convertLayeredFromV1alpha1 converts a layered v1alpha1 configuration to LayeredConfig
+func convertLayeredFromV1alpha1(in *v1alpha1.LayeredConfig) *LayeredConfig {
+	out := &LayeredConfig{Base: *convertFromV1alpha1(&in.Base)}
+	if in.Overlays != nil {
+		out.Overlays = make(map[string]*Config, len(in.Overlays))
+		for name, overlay := range in.Overlays {
+			if overlay != nil {
+				out.Overlays[name] = convertFromV1alpha1(overlay)
+			} else {
+				out.Overlays[name] = nil
+			}
+		}
+	}
+	return out
+}
+
+// convertToV1alpha1 converts Config back to v1alpha1, the reverse of convertFromV1alpha1. Fields added in later
+// versions, such as instrumentation.java.resources, are dropped.
+func convertToV1alpha1(in *Config) *v1alpha1.Config {
+	out := &v1alpha1.Config{
+		Env:                          convertSlice(in.Env, convertEnvVarToV1alpha1),
+		RemoveEnv:                    in.RemoveEnv,
+		Downward:                     in.Downward,
+		DnsOptions:                   in.DnsOptions,
+		RemovePodAntiAffinity:        in.RemovePodAntiAffinity,
+		AutomountServiceAccountToken: in.AutomountServiceAccountToken,
+		Defaults:                     in.Defaults,
+		Patches:                      convertSlice(in.Patches, convertPodPatchToV1alpha1),
+		AllowedOverrides:             in.AllowedOverrides,
+	}
+	out.RuntimeTuning = convertSlice(in.RuntimeTuning, func(r RuntimeTuningRule) v1alpha1.RuntimeTuningRule { return v1alpha1.RuntimeTuningRule(r) })
+	out.RequiredNodeAffinityTerms = convertSlice(in.RequiredNodeAffinityTerms, func(t NodeSelectorTerm) v1alpha1.NodeSelectorTerm { return v1alpha1.NodeSelectorTerm(t) })
+	out.PreferredNodeAffinityTerms = convertSlice(in.PreferredNodeAffinityTerms, func(t PreferredSchedulingTerm) v1alpha1.PreferredSchedulingTerm {
+		return v1alpha1.PreferredSchedulingTerm(t)
+	})
+	out.Tolerations = convertSlice(in.Tolerations, func(t Toleration) v1alpha1.Toleration { return v1alpha1.Toleration(t) })
+	out.TopologyConstraints = convertSlice(in.TopologyConstraints, func(c TopologySpreadConstraint) v1alpha1.TopologySpreadConstraint {
+		return v1alpha1.TopologySpreadConstraint(c)
+	})
+	if java := in.Instrumentation.Java; java != nil {
+		out.Instrumentation.Java = &v1alpha1.JavaInstrumentation{Image: java.Image, AgentPath: java.AgentPath, Images: java.Images, MountPath: java.MountPath}
+	}
+	if otel := in.OTel; otel != nil {
+		out.OTel = &v1alpha1.OpenTelemetry{ServiceNameLabels: otel.ServiceNameLabels, ClusterName: otel.ClusterName, ResourceAttributes: otel.ResourceAttributes}
+	}
+	if tb := in.TrustBundle; tb != nil {
+		out.TrustBundle = &v1alpha1.TrustBundle{ConfigMap: tb.ConfigMap, Secret: tb.Secret, Key: tb.Key, MountPath: tb.MountPath,
+			JavaTrustStoreKey: tb.JavaTrustStoreKey, JavaTrustStorePassword: tb.JavaTrustStorePassword}
+	}
+	if proxy := in.Proxy; proxy != nil {
+		out.Proxy = &v1alpha1.Proxy{HTTPProxy: proxy.HTTPProxy, HTTPSProxy: proxy.HTTPSProxy, ClusterCIDRs: proxy.ClusterCIDRs, NoProxy: proxy.NoProxy}
+	}
+	if tz := in.Timezone; tz != nil {
+		out.Timezone = &v1alpha1.Timezone{Name: tz.Name, ConfigMap: tz.ConfigMap, Key: tz.Key, HostPath: tz.HostPath}
+	}
+	if wi := in.AzureWorkloadIdentity; wi != nil {
+		out.AzureWorkloadIdentity = &v1alpha1.AzureWorkloadIdentity{TenantID: wi.TenantID, AuthorityHost: wi.AuthorityHost, TokenExpirationSeconds: wi.TokenExpirationSeconds}
+	}
+	return out
+}
+
+func convertEnvVarToV1alpha1(in EnvVar) v1alpha1.EnvVar {
+	out := v1alpha1.EnvVar{EnvVar: in.EnvVar, When: in.When, Mode: in.Mode, Separator: in.Separator, Position: in.Position}
+	if in.KeyVaultRef != nil {
+		out.KeyVaultRef = &v1alpha1.KeyVaultRef{Vault: in.KeyVaultRef.Vault, Secret: in.KeyVaultRef.Secret}
+	}
+	return out
+}
+
+func convertPodPatchToV1alpha1(in PodPatch) v1alpha1.PodPatch {
+	out := v1alpha1.PodPatch{Op: in.Op, Path: in.Path, From: in.From, Value: in.Value, StrategicMerge: in.StrategicMerge}
+	if in.Test != nil {
+		out.Test = &v1alpha1.PatchTest{Path: in.Test.Path, Exists: in.Test.Exists}
+	}
+	return out
+}
+
+// convertSlice converts each item of in, keeping a nil slice nil
+func convertSlice[In, Out any](in []In, convert func(In) Out) []Out {
+	if in == nil {
+		return nil
+	}
+	out := make([]Out, len(in))
+	for i, item := range in {
+		out[i] = convert(item)
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"k8s-env-injector/config/v1alpha2"
+)
+
+// convertFromV1alpha2 converts a v1alpha2 configuration to Config, field by field as convertFromV1alpha1 does
+func convertFromV1alpha2(in *v1alpha2.Config) *Config {
+	out := &Config{
+		Env:                          convertSlice(in.Env, convertEnvVarFromV1alpha2),
+		RemoveEnv:                    in.RemoveEnv,
+		Downward:                     in.Downward,
+		DnsOptions:                   in.DnsOptions,
+		RemovePodAntiAffinity:        in.RemovePodAntiAffinity,
+		AutomountServiceAccountToken: in.AutomountServiceAccountToken,
+		Defaults:                     in.Defaults,
+		Patches:                      convertSlice(in.Patches, convertPodPatchFromV1alpha2),
+		AllowedOverrides:             in.AllowedOverrides,
+	}
+	out.RuntimeTuning = convertSlice(in.RuntimeTuning, func(r v1alpha2.RuntimeTuningRule) RuntimeTuningRule { return RuntimeTuningRule(r) })
+	out.RequiredNodeAffinityTerms = convertSlice(in.RequiredNodeAffinityTerms, func(t v1alpha2.NodeSelectorTerm) NodeSelectorTerm { return NodeSelectorTerm(t) })
+	out.PreferredNodeAffinityTerms = convertSlice(in.PreferredNodeAffinityTerms, func(t v1alpha2.PreferredSchedulingTerm) PreferredSchedulingTerm { return PreferredSchedulingTerm(t) })
+	out.Tolerations = convertSlice(in.Tolerations, func(t v1alpha2.Toleration) Toleration { return Toleration(t) })
+	out.TopologyConstraints = convertSlice(in.TopologyConstraints, func(c v1alpha2.TopologySpreadConstraint) TopologySpreadConstraint { return TopologySpreadConstraint(c) })
+	if java := in.Instrumentation.Java; java != nil {
+		out.Instrumentation.Java = &JavaInstrumentation{Image: java.Image, AgentPath: java.AgentPath, Images: java.Images, MountPath: java.MountPath,
+			Resources: java.Resources}
+	}
+	if otel := in.OTel; otel != nil {
+		out.OTel = &OpenTelemetry{ServiceNameLabels: otel.ServiceNameLabels, ClusterName: otel.ClusterName, ResourceAttributes: otel.ResourceAttributes}
+	}
+	if tb := in.TrustBundle; tb != nil {
+		out.TrustBundle = &TrustBundle{ConfigMap: tb.ConfigMap, Secret: tb.Secret, Key: tb.Key, MountPath: tb.MountPath,
+			JavaTrustStoreKey: tb.JavaTrustStoreKey, JavaTrustStorePassword: tb.JavaTrustStorePassword}
+	}
+	if proxy := in.Proxy; proxy != nil {
+		out.Proxy = &Proxy{HTTPProxy: proxy.HTTPProxy, HTTPSProxy: proxy.HTTPSProxy, ClusterCIDRs: proxy.ClusterCIDRs, NoProxy: proxy.NoProxy}
+	}
+	if tz := in.Timezone; tz != nil {
+		out.Timezone = &Timezone{Name: tz.Name, ConfigMap: tz.ConfigMap, Key: tz.Key, HostPath: tz.HostPath}
+	}
+	if wi := in.AzureWorkloadIdentity; wi != nil {
+		out.AzureWorkloadIdentity = &AzureWorkloadIdentity{TenantID: wi.TenantID, AuthorityHost: wi.AuthorityHost, TokenExpirationSeconds: wi.TokenExpirationSeconds}
+	}
+	return out
+}
+
+func convertEnvVarFromV1alpha2(in v1alpha2.EnvVar) EnvVar {
+	out := EnvVar{EnvVar: in.EnvVar, When: in.When, Mode: in.Mode, Separator: in.Separator, Position: in.Position}
+	if in.KeyVaultRef != nil {
+		out.KeyVaultRef = &KeyVaultRef{Vault: in.KeyVaultRef.Vault, Secret: in.KeyVaultRef.Secret}
+	}
+	return out
+}
+
+func convertPodPatchFromV1alpha2(in v1alpha2.PodPatch) PodPatch {
+	out := PodPatch{Op: in.Op, Path: in.Path, From: in.From, Value: in.Value, StrategicMerge: in.StrategicMerge}
+	if in.Test != nil {
+		out.Test = &PatchTest{Path: in.Test.Path, Exists: in.Test.Exists}
+	}
+	return out
+}
+
+// convertLayeredFromV1alpha2 converts a layered v1alpha2 configuration to LayeredConfig
+func convertLayeredFromV1alpha2(in *v1alpha2.LayeredConfig) *LayeredConfig {
+	out := &LayeredConfig{Base: *convertFromV1alpha2(&in.Base)}
+	if in.Overlays != nil {
+		out.Overlays = make(map[string]*Config, len(in.Overlays))
+		for name, overlay := range in.Overlays {
+			if overlay != nil {
+				out.Overlays[name] = convertFromV1alpha2(overlay)
+			} else {
+				out.Overlays[name] = nil
+			}
+		}
+	}
+	return out
+}
+
+// convertToV1alpha2 converts Config back to v1alpha2, the reverse of convertFromV1alpha2
+func convertToV1alpha2(in *Config) *v1alpha2.Config {
+	out := &v1alpha2.Config{
+		Env:                          convertSlice(in.Env, convertEnvVarToV1alpha2),
+		RemoveEnv:                    in.RemoveEnv,
+		Downward:                     in.Downward,
+		DnsOptions:                   in.DnsOptions,
+		RemovePodAntiAffinity:        in.RemovePodAntiAffinity,
+		AutomountServiceAccountToken: in.AutomountServiceAccountToken,
+		Defaults:                     in.Defaults,
+		Patches:                      convertSlice(in.Patches, convertPodPatchToV1alpha2),
+		AllowedOverrides:             in.AllowedOverrides,
+	}
+	out.RuntimeTuning = convertSlice(in.RuntimeTuning, func(r RuntimeTuningRule) v1alpha2.RuntimeTuningRule { return v1alpha2.RuntimeTuningRule(r) })
+	out.RequiredNodeAffinityTerms = convertSlice(in.RequiredNodeAffinityTerms, func(t NodeSelectorTerm) v1alpha2.NodeSelectorTerm { return v1alpha2.NodeSelectorTerm(t) })
+	out.PreferredNodeAffinityTerms = convertSlice(in.PreferredNodeAffinityTerms, func(t PreferredSchedulingTerm) v1alpha2.PreferredSchedulingTerm {
+		return v1alpha2.PreferredSchedulingTerm(t)
+	})
+	out.Tolerations = convertSlice(in.Tolerations, func(t Toleration) v1alpha2.Toleration { return v1alpha2.Toleration(t) })
+	out.TopologyConstraints = convertSlice(in.TopologyConstraints, func(c TopologySpreadConstraint) v1alpha2.TopologySpreadConstraint {
+		return v1alpha2.TopologySpreadConstraint(c)
+	})
+	if java := in.Instrumentation.Java; java != nil {
+		out.Instrumentation.Java = &v1alpha2.JavaInstrumentation{Image: java.Image, AgentPath: java.AgentPath, Images: java.Images, MountPath: java.MountPath,
+			Resources: java.Resources}
+	}
+	if otel := in.OTel; otel != nil {
+		out.OTel = &v1alpha2.OpenTelemetry{ServiceNameLabels: otel.ServiceNameLabels, ClusterName: otel.ClusterName, ResourceAttributes: otel.ResourceAttributes}
+	}
+	if tb := in.TrustBundle; tb != nil {
+		out.TrustBundle = &v1alpha2.TrustBundle{ConfigMap: tb.ConfigMap, Secret: tb.Secret, Key: tb.Key, MountPath: tb.MountPath,
+			JavaTrustStoreKey: tb.JavaTrustStoreKey, JavaTrustStorePassword: tb.JavaTrustStorePassword}
+	}
+	if proxy := in.Proxy; proxy != nil {
+		out.Proxy = &v1alpha2.Proxy{HTTPProxy: proxy.HTTPProxy, HTTPSProxy: proxy.HTTPSProxy, ClusterCIDRs: proxy.ClusterCIDRs, NoProxy: proxy.NoProxy}
+	}
+	if tz := in.Timezone; tz != nil {
+		out.Timezone = &v1alpha2.Timezone{Name: tz.Name, ConfigMap: tz.ConfigMap, Key: tz.Key, HostPath: tz.HostPath}
+	}
+	if wi := in.AzureWorkloadIdentity; wi != nil {
+		out.AzureWorkloadIdentity = &v1alpha2.AzureWorkloadIdentity{TenantID: wi.TenantID, AuthorityHost: wi.AuthorityHost, TokenExpirationSeconds: wi.TokenExpirationSeconds}
+	}
+	return out
+}
+
+func convertEnvVarToV1alpha2(in EnvVar) v1alpha2.EnvVar {
+	out := v1alpha2.EnvVar{EnvVar: in.EnvVar, When: in.When, Mode: in.Mode, Separator: in.Separator, Position: in.Position}
+	if in.KeyVaultRef != nil {
+		out.KeyVaultRef = &v1alpha2.KeyVaultRef{Vault: in.KeyVaultRef.Vault, Secret: in.KeyVaultRef.Secret}
+	}
+	return out
+}
+
+func convertPodPatchToV1alpha2(in PodPatch) v1alpha2.PodPatch {
+	out := v1alpha2.PodPatch{Op: in.Op, Path: in.Path, From: in.From, Value: in.Value, StrategicMerge: in.StrategicMerge}
+	if in.Test != nil {
+		out.Test = &v1alpha2.PatchTest{Path: in.Test.Path, Exists: in.Test.Exists}
+	}
+	return out
+}
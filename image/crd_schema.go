@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+
+	"k8s-env-injector/config/v1alpha2"
+)
+
+// openAPISchema is the subset of the OpenAPI v3 schema of a CustomResourceDefinition the generated schemas use.
+// The API server only accepts structural schemas, so there is no $ref and each node has a single type.
+type openAPISchema struct {
+	Description           string                    `yaml:"description,omitempty"`
+	Type                  string                    `yaml:"type,omitempty"`
+	Format                string                    `yaml:"format,omitempty"`
+	Nullable              bool                      `yaml:"nullable,omitempty"`
+	Enum                  []string                  `yaml:"enum,omitempty,flow"`
+	Required              []string                  `yaml:"required,omitempty,flow"`
+	AnyOf                 []*openAPISchema          `yaml:"anyOf,omitempty"`
+	Properties            map[string]*openAPISchema `yaml:"properties,omitempty"`
+	AdditionalProperties  *openAPISchema            `yaml:"additionalProperties,omitempty"`
+	Items                 *openAPISchema            `yaml:"items,omitempty"`
+	IntOrString           bool                      `yaml:"x-kubernetes-int-or-string,omitempty"`
+	PreserveUnknownFields bool                      `yaml:"x-kubernetes-preserve-unknown-fields,omitempty"`
+}
+
+// customResourceDefinition is the part of an apiextensions.k8s.io/v1 CustomResourceDefinition the policies use
+type customResourceDefinition struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Group string `yaml:"group"`
+		Names struct {
+			Kind     string `yaml:"kind"`
+			ListKind string `yaml:"listKind"`
+			Plural   string `yaml:"plural"`
+			Singular string `yaml:"singular"`
+		} `yaml:"names"`
+		Scope    string       `yaml:"scope"`
+		Versions []crdVersion `yaml:"versions"`
+	} `yaml:"spec"`
+}
+
+type crdVersion struct {
+	Name         string `yaml:"name"`
+	Served       bool   `yaml:"served"`
+	Storage      bool   `yaml:"storage"`
+	Subresources struct {
+		Status struct{} `yaml:"status"`
+	} `yaml:"subresources"`
+	AdditionalPrinterColumns []crdPrinterColumn `yaml:"additionalPrinterColumns"`
+	Schema                   struct {
+		OpenAPIV3Schema *openAPISchema `yaml:"openAPIV3Schema"`
+	} `yaml:"schema"`
+}
+
+type crdPrinterColumn struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	JSONPath string `yaml:"jsonPath"`
+}
+
+// policyCRDResources are the resources of the policy kinds, by kind
+var policyCRDResources = map[string]struct {
+	resource string
+	scope    string
+}{
+	"EnvInjectionPolicy":           {envInjectionPolicyGVR.Resource, "Cluster"},
+	"NamespacedEnvInjectionPolicy": {namespacedEnvInjectionPolicyGVR.Resource, "Namespaced"},
+}
+
+// writePolicyCRD writes the CustomResourceDefinition of the policy kind to out
+func writePolicyCRD(kind string, out io.Writer) error {
+	resource, ok := policyCRDResources[kind]
+	if !ok {
+		return fmt.Errorf("unknown policy kind %q, expected EnvInjectionPolicy or NamespacedEnvInjectionPolicy", kind)
+	}
+
+	var crd customResourceDefinition
+	crd.APIVersion = "apiextensions.k8s.io/v1"
+	crd.Kind = "CustomResourceDefinition"
+	crd.Metadata.Name = resource.resource + "." + policyGroup
+	crd.Spec.Group = policyGroup
+	crd.Spec.Names.Kind = kind
+	crd.Spec.Names.ListKind = kind + "List"
+	crd.Spec.Names.Plural = resource.resource
+	crd.Spec.Names.Singular = strings.ToLower(kind)
+	crd.Spec.Scope = resource.scope
+
+	version := crdVersion{Name: policyVersion, Served: true, Storage: true}
+	version.AdditionalPrinterColumns = []crdPrinterColumn{
+		{Name: "Priority", Type: "integer", JSONPath: ".spec." + policyPriorityField},
+		{Name: "Ready", Type: "string", JSONPath: `.status.conditions[?(@.type=="` + policyConditionReady + `")].status`},
+		{Name: "Reason", Type: "string", JSONPath: `.status.conditions[?(@.type=="` + policyConditionReady + `")].reason`},
+		{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+	}
+	version.Schema.OpenAPIV3Schema = &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{
+		"spec":   policySpecSchema(),
+		"status": policyStatusSchema(),
+	}}
+	crd.Spec.Versions = []crdVersion{version}
+
+	enc := yamlv3.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&crd); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// policySpecSchema returns the schema of the spec of a policy, the fields of a configuration file and a
+// priority, so the API server rejects a policy of the wrong shape when it is applied. The v1alpha2 layout
+// is a superset of v1alpha1, so either apiVersion is accepted.
+func policySpecSchema() *openAPISchema {
+	g := schemaGenerator{definitions: map[string]*jsonSchema{}}
+	spec := g.structural(g.schemaFor(reflect.TypeOf(v1alpha2.EnvInjectorConfig{})), nil)
+	spec.Description = "The fields of the configuration file, validated by the webhook, and a priority."
+	spec.Properties["apiVersion"] = &openAPISchema{Type: "string", Enum: []string{configAPIVersionV1alpha1, configAPIVersionV1alpha2}}
+	spec.Properties["kind"] = &openAPISchema{Type: "string", Enum: []string{configKind}}
+	// only the configuration file decides which fields team overrides may set
+	delete(spec.Properties, "allowedOverrides")
+	spec.Properties[policyPriorityField] = &openAPISchema{
+		Description: "Policies are applied in order of priority, then name.",
+		Type:        "integer",
+		Format:      "int64",
+	}
+	return spec
+}
+
+// policyStatusSchema returns the schema of the status the policy controller writes
+func policyStatusSchema() *openAPISchema {
+	str := func() *openAPISchema { return &openAPISchema{Type: "string"} }
+	int64Schema := func() *openAPISchema { return &openAPISchema{Type: "integer", Format: "int64"} }
+	return &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{
+		"observedGeneration": int64Schema(),
+		"conditions": {Type: "array", Items: &openAPISchema{
+			Type:     "object",
+			Required: []string{"type", "status", "reason", "message", "lastTransitionTime"},
+			Properties: map[string]*openAPISchema{
+				"type":               str(),
+				"status":             str(),
+				"reason":             str(),
+				"message":            str(),
+				"observedGeneration": int64Schema(),
+				"lastTransitionTime": {Type: "string", Format: "date-time"},
+			},
+		}},
+	}}
+}
+
+// structural turns the JSON Schema into a structural OpenAPI schema: definitions are inlined, null becomes
+// nullable and keys that match no field are pruned by the API server rather than forbidden. Unlike ghodss/yaml,
+// the API server does not turn numbers into strings, so string fields only take strings, as on any other resource.
+func (g *schemaGenerator) structural(s *jsonSchema, expanding []string) *openAPISchema {
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/definitions/")
+		if slices.Contains(expanding, name) {
+			// a structural schema cannot refer back to itself, so a recursive type takes any value
+			return &openAPISchema{PreserveUnknownFields: true}
+		}
+		return g.structural(g.definitions[name], append(expanding, name))
+	}
+	if len(s.AnyOf) == 2 && s.AnyOf[1].Type == "null" {
+		out := g.structural(s.AnyOf[0], expanding)
+		out.Nullable = true
+		return out
+	}
+	if len(s.AnyOf) > 0 {
+		// resource.Quantity, a number or a string
+		return &openAPISchema{AnyOf: []*openAPISchema{{Type: "integer"}, {Type: "string"}}, IntOrString: true}
+	}
+
+	out := &openAPISchema{Enum: s.Enum}
+	switch typ := s.Type.(type) {
+	case nil:
+		out.PreserveUnknownFields = true
+	case string:
+		out.Type = typ
+	case []string:
+		if slices.Contains(typ, "null") {
+			out.Nullable = true
+		}
+		out.Type = typ[0]
+	}
+	if len(s.Properties) > 0 {
+		out.Properties = map[string]*openAPISchema{}
+		for name, p := range s.Properties {
+			out.Properties[name] = g.structural(p, expanding)
+		}
+	}
+	if additional, ok := s.AdditionalProperties.(*jsonSchema); ok {
+		out.AdditionalProperties = g.structural(additional, expanding)
+	}
+	if s.Items != nil {
+		out.Items = g.structural(s.Items, expanding)
+	}
+	return out
+}
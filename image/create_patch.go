@@ -7,12 +7,65 @@ import (
 	corev1 "k8s.io/api/core/v1"
 )
 
-// createPatch creates a mutation patch for resources
-func createPatch(pod *corev1.Pod, envConfig *Config, annotations map[string]string) ([]byte, error) {
+// createPatch creates a mutation patch for resources. Items with a `when` expression are only injected when it
+// holds for vars, and serviceAccount, when known, drives the workload identity injection.
+func createPatch(pod *corev1.Pod, envConfig *Config, annotations map[string]string, vars map[string]interface{}, serviceAccount *corev1.ServiceAccount) ([]byte, error) {
 	var patches []patchOperation
 
+	env, keyVaults := resolveKeyVaultRefs(selectWhen[EnvVar](envConfig.Env, vars))
+	tolerations := selectWhen[corev1.Toleration](envConfig.Tolerations, vars)
+	topologyConstraints := selectWhen[corev1.TopologySpreadConstraint](envConfig.TopologyConstraints, vars)
+	requiredNodeAffinityTerms := selectWhen[corev1.NodeSelectorTerm](envConfig.RequiredNodeAffinityTerms, vars)
+	preferredNodeAffinityTerms := selectWhen[corev1.PreferredSchedulingTerm](envConfig.PreferredNodeAffinityTerms, vars)
+
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+
 	for idx, container := range pod.Spec.Containers {
-		patches = append(patches, addEnv(container.Env, envConfig.Env, fmt.Sprintf("/spec/containers/%d/env", idx))...)
+		basePath := fmt.Sprintf("/spec/containers/%d/env", idx)
+		containerEnv := container.Env
+		if len(envConfig.RemoveEnv) > 0 {
+			var removed []patchOperation
+			containerEnv, removed = removeEnv(container.Env, envConfig.RemoveEnv, basePath)
+			patches = append(patches, removed...)
+		}
+		// per container variables come after the configured env
+		containerEnvVars := append([]EnvVar{}, env...)
+		containerEnvVars = append(containerEnvVars, downwardEnv(envConfig.Downward, container.Name)...)
+		containerEnvVars = append(containerEnvVars, runtimeTuningEnv(envConfig.RuntimeTuning, container, containerEnv)...)
+		containerEnvVars = append(containerEnvVars, javaAgentEnv(envConfig.Instrumentation.Java, container)...)
+		containerEnvVars = append(containerEnvVars, otelEnv(envConfig.OTel, pod, container, containerEnv)...)
+		containerEnvVars = append(containerEnvVars, trustBundleEnv(envConfig.TrustBundle, containerEnv)...)
+		containerEnvVars = append(containerEnvVars, proxyEnv(envConfig.Proxy, pod, containerEnv)...)
+		containerEnvVars = append(containerEnvVars, timezoneEnv(envConfig.Timezone, containerEnv)...)
+		containerEnvVars = append(containerEnvVars, azureWorkloadIdentityEnv(envConfig.AzureWorkloadIdentity, serviceAccount, pod, container, containerEnv)...)
+		containerEnv, inserted, remainingEnv := insertEnv(containerEnv, containerEnvVars, basePath)
+		patches = append(patches, inserted...)
+		patches = append(patches, addEnv(containerEnv, mergeEnvValues(containerEnv, remainingEnv), basePath)...)
+	}
+	// init containers, e.g. database migrations, often call Azure too, so they get the workload identity
+	// variables; the rest of the configuration is for the containers that serve
+	for idx, container := range pod.Spec.InitContainers {
+		basePath := fmt.Sprintf("/spec/initContainers/%d/env", idx)
+		initEnvVars := azureWorkloadIdentityEnv(envConfig.AzureWorkloadIdentity, serviceAccount, pod, container, container.Env)
+		patches = append(patches, addEnv(container.Env, mergeEnvValues(container.Env, initEnvVars), basePath)...)
+	}
+	if len(keyVaults) > 0 {
+		patches = append(patches, addKeyVaultVolumes(pod, keyVaults)...)
+	}
+	if envConfig.Instrumentation.Java != nil {
+		patches = append(patches, addJavaInstrumentation(pod, envConfig.Instrumentation.Java)...)
+	}
+	if envConfig.TrustBundle != nil {
+		patches = append(patches, addTrustBundle(pod, envConfig.TrustBundle)...)
+	}
+	if envConfig.Timezone != nil {
+		patches = append(patches, addTimezone(pod, envConfig.Timezone)...)
+	}
+	if envConfig.AzureWorkloadIdentity != nil {
+		patches = append(patches, addAzureWorkloadIdentity(pod, envConfig.AzureWorkloadIdentity, serviceAccount)...)
 	}
 	if len(envConfig.DnsOptions) > 0 {
 		if pod.Spec.DNSConfig == nil {
@@ -21,19 +74,19 @@ func createPatch(pod *corev1.Pod, envConfig *Config, annotations map[string]stri
 		}
 		patches = append(patches, addDnsOptions(pod.Spec.DNSConfig.Options, envConfig.DnsOptions, fmt.Sprintf("/spec/dnsConfig/options"))...)
 	}
-	if len(envConfig.Tolerations) > 0 {
+	if len(tolerations) > 0 {
 		if pod.Spec.Tolerations == nil {
 			pod.Spec.Tolerations = []corev1.Toleration{}
 			patches = append(patches, patchOperation{Op: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{}})
 		}
-		patches = append(patches, addTolerations(pod.Spec.Tolerations, envConfig.Tolerations, fmt.Sprintf("/spec/tolerations"))...)
+		patches = append(patches, addTolerations(pod.Spec.Tolerations, tolerations, fmt.Sprintf("/spec/tolerations"))...)
 	}
-	if len(envConfig.TopologyConstraints) > 0 {
+	if len(topologyConstraints) > 0 {
 		if pod.Spec.TopologySpreadConstraints == nil {
 			pod.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{}
 			patches = append(patches, patchOperation{Op: "add", Path: "/spec/topologySpreadConstraints", Value: []corev1.TopologySpreadConstraint{}})
 		}
-		patches = append(patches, addTopologySpreadConstraints(pod.Spec.TopologySpreadConstraints, envConfig.TopologyConstraints, fmt.Sprintf("/spec/topologySpreadConstraints"))...)
+		patches = append(patches, addTopologySpreadConstraints(pod.Spec.TopologySpreadConstraints, topologyConstraints, fmt.Sprintf("/spec/topologySpreadConstraints"))...)
 	}
 	if envConfig.RemovePodAntiAffinity {
 		if pod.Spec.Affinity != nil && pod.Spec.Affinity.PodAntiAffinity != nil {
@@ -41,7 +94,7 @@ func createPatch(pod *corev1.Pod, envConfig *Config, annotations map[string]stri
 			patches = append(patches, removePodAntiAffinity("/spec/affinity/podAntiAffinity")...)
 		}
 	}
-	if len(envConfig.RequiredNodeAffinityTerms) > 0 {
+	if len(requiredNodeAffinityTerms) > 0 {
 		if pod.Spec.Affinity == nil {
 			pod.Spec.Affinity = &corev1.Affinity{}
 			patches = append(patches, patchOperation{Op: "add", Path: "/spec/affinity", Value: corev1.Affinity{}})
@@ -55,9 +108,9 @@ func createPatch(pod *corev1.Pod, envConfig *Config, annotations map[string]stri
 			patches = append(patches, patchOperation{Op: "add", Path: "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution", Value: corev1.NodeSelector{}})
 		}
 		patches = append(patches, addRequiredNodeAffinityTerms(pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms,
-			envConfig.RequiredNodeAffinityTerms, fmt.Sprintf("/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms"))...)
+			requiredNodeAffinityTerms, fmt.Sprintf("/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms"))...)
 	}
-	if len(envConfig.PreferredNodeAffinityTerms) > 0 {
+	if len(preferredNodeAffinityTerms) > 0 {
 		if pod.Spec.Affinity == nil {
 			pod.Spec.Affinity = &corev1.Affinity{}
 			patches = append(patches, patchOperation{Op: "add", Path: "/spec/affinity", Value: corev1.Affinity{}})
@@ -71,7 +124,28 @@ func createPatch(pod *corev1.Pod, envConfig *Config, annotations map[string]stri
 			patches = append(patches, patchOperation{Op: "add", Path: "/spec/affinity/nodeAffinity/preferredDuringSchedulingIgnoredDuringExecution", Value: []corev1.PreferredSchedulingTerm{}})
 		}
 		patches = append(patches, addPreferredNodeAffinityTerms(pod.Spec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
-			envConfig.PreferredNodeAffinityTerms, "/spec/affinity/nodeAffinity/preferredDuringSchedulingIgnoredDuringExecution")...)
+			preferredNodeAffinityTerms, "/spec/affinity/nodeAffinity/preferredDuringSchedulingIgnoredDuringExecution")...)
+	}
+	if envConfig.AutomountServiceAccountToken != nil && !annotationOptOut(pod.Annotations, admissionWebhookAnnotationAutomountKey) {
+		automount := addAutomountServiceAccountToken(pod.Spec.AutomountServiceAccountToken, envConfig.AutomountServiceAccountToken, "/spec/automountServiceAccountToken")
+		patches = append(patches, automount...)
+		if len(automount) > 0 && !*envConfig.AutomountServiceAccountToken {
+			patches = append(patches, removeServiceAccountTokenVolume(pod)...)
+		}
+	}
+	if len(envConfig.Defaults) > 0 {
+		defaults, err := addDefaults(original, patches, envConfig.Defaults)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, defaults...)
+	}
+	if len(envConfig.Patches) > 0 {
+		customPatches, err := addCustomPatches(original, patches, envConfig.Patches)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, customPatches...)
 	}
 
 	patches = append(patches, updateAnnotation(pod.Annotations, annotations)...)
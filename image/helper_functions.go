@@ -1,30 +1,85 @@
 package main
 
 import (
+	"crypto"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func loadConfig(configFile string) (*Config, error) {
-	data, err := os.ReadFile(configFile)
+// loadConfig reads and validates the configuration in configFile, taking the overlay for cluster from layered
+// files. When configFile is a directory, every *.yaml file in it is validated and the files are merged in lexical
+// order, later files replacing or adding to the items of earlier ones as mergeConfig does. With a key, a file must
+// come with a detached signature, file.sig, that matches it, and a directory with SHA256SUMS.sig, the signature of
+// the manifest of its files that configManifest builds. The sha256 sum of the file, or of the names and content of
+// the files, and of the signature, is returned whenever they could be read, even if the configuration is invalid.
+func loadConfig(configFile, cluster string, key crypto.PublicKey) (cfg *Config, sum [sha256.Size]byte, err error) {
+	info, err := os.Stat(configFile)
 	if err != nil {
-		return nil, err
+		return nil, sum, err
+	}
+	files := []string{configFile}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(configFile, "*.yaml")); err != nil {
+			return nil, sum, err
+		}
+		if len(files) == 0 {
+			return nil, sum, fmt.Errorf("%s: no *.yaml files", configFile)
+		}
 	}
-	glog.Infof("New configuration: sha256sum %x", sha256.Sum256(data))
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	h := sha256.New()
+	names := make([]string, len(files))
+	contents := make([][]byte, len(files))
+	for i, file := range files {
+		if contents[i], err = os.ReadFile(file); err != nil {
+			return nil, sum, err
+		}
+		names[i] = filepath.Base(file)
+		if info.IsDir() {
+			fmt.Fprintf(h, "%s\x00%d\x00", names[i], len(contents[i]))
+		}
+		h.Write(contents[i])
+	}
+	if key != nil {
+		signed, sigFile := contents[0], configFile+configSignatureSuffix
+		if info.IsDir() {
+			signed, sigFile = configManifest(names, contents), filepath.Join(configFile, configManifestSignature)
+		}
+		sig, err := os.ReadFile(sigFile)
+		if err == nil {
+			h.Write(sig)
+			err = verifyConfigSignature(key, signed, sig)
+		}
+		if err != nil {
+			copy(sum[:], h.Sum(nil))
+			return nil, sum, fmt.Errorf("%s: refusing unverified configuration: %w", configFile, err)
+		}
 	}
-	glog.Infof("Configuration data: %+v", &cfg)
+	copy(sum[:], h.Sum(nil))
 
-	return &cfg, nil
+	var errs []error
+	for i, file := range files {
+		part, err := decodeConfigFile(file, contents[i], cluster)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case cfg == nil:
+			cfg = part
+		default:
+			cfg = mergeConfig(cfg, part)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, sum, errors.Join(errs...)
+	}
+	return cfg, sum, nil
 }
 
 // mutationRequired checks whether the target resource needs to be mutated.
@@ -62,6 +117,15 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 	return required
 }
 
+// annotationOptOut reports whether the annotation key is set to one of the values used to switch a feature off
+func annotationOptOut(annotations map[string]string, key string) bool {
+	switch strings.ToLower(annotations[key]) {
+	case "n", "no", "false", "off":
+		return true
+	}
+	return false
+}
+
 func updateAnnotation(target map[string]string, annotations map[string]string) (patch []patchOperation) {
 	for k, v := range annotations {
 		if target == nil {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// informerResyncPeriod is how often the cached objects the webhook looks up are fully resynced
+	informerResyncPeriod = 10 * time.Minute
+	// informerSyncTimeout bounds how long startup waits for the caches, e.g. when RBAC is missing
+	informerSyncTimeout = 30 * time.Second
+)
+
+// newKubeClients returns a clientset for the cluster, and a dynamic client for the custom resources, using the
+// in-cluster service account unless a kubeconfig is given
+func newKubeClients(kubeconfig string) (kubernetes.Interface, dynamic.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, dynamicClient, nil
+}
+
+// startInformers registers the cached listers the webhook needs and starts them. The returned func waits for the
+// initial sync, see waitForCacheSync.
+func (whsvr *WebhookServer) startInformers(client kubernetes.Interface, stopCh <-chan struct{}) func() {
+	factory := informers.NewSharedInformerFactory(client, informerResyncPeriod)
+	whsvr.namespaces = factory.Core().V1().Namespaces().Lister()
+	whsvr.serviceAccounts = factory.Core().V1().ServiceAccounts().Lister()
+
+	factory.Start(stopCh)
+	return func() { waitForCacheSync(factory.WaitForCacheSync, stopCh, "lookups will miss") }
+}
+
+// waitForCacheSync waits for the caches of a started informer factory to sync, for at most informerSyncTimeout,
+// and reports whether they all did. A cache that does not sync in time, e.g. when RBAC is missing, is logged with
+// what happens until it does, and left to catch up in the background.
+func waitForCacheSync[T comparable](wait func(stopCh <-chan struct{}) map[T]bool, stopCh <-chan struct{}, missing string) bool {
+	timeoutCh, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(timeoutCh)
+		select {
+		case <-time.After(informerSyncTimeout):
+		case <-stopCh:
+		case <-done:
+		}
+	}()
+
+	all := true
+	for informer, synced := range wait(timeoutCh) {
+		if !synced {
+			glog.Warningf("Cache for %v has not synced, %s until it does", informer, missing)
+			all = false
+		}
+	}
+	return all
+}
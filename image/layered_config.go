@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// LayeredConfig is a configuration file shared by several clusters: the base configuration, and the overlays
+// layered on top of it for each cluster by name
+type LayeredConfig struct {
+	Base     Config             `yaml:"base" json:"base"`
+	Overlays map[string]*Config `yaml:"overlays,omitempty" json:"overlays,omitempty"`
+}
+
+// validate checks the base and each overlay, and that there is a cluster to select an overlay for
+func (l *LayeredConfig) validate(cluster string) []error {
+	errs := prefixConfigErrors("base", unwrapErrors(validateConfig(&l.Base)))
+	names := make([]string, 0, len(l.Overlays))
+	for name := range l.Overlays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if overlay := l.Overlays[name]; overlay != nil {
+			errs = append(errs, prefixConfigErrors("overlays."+name, unwrapErrors(validateConfig(overlay)))...)
+		}
+	}
+	if cluster == "" && len(l.Overlays) > 0 {
+		errs = append(errs, configErrorf("overlays", "no cluster to select an overlay for, set -cluster or CLUSTER_NAME"))
+	}
+	return errs
+}
+
+// configFor returns the base with the overlay for cluster, if any, merged into it with mergeConfig
+func (l *LayeredConfig) configFor(file, cluster string) *Config {
+	overlay, ok := l.Overlays[cluster]
+	if !ok && len(l.Overlays) > 0 {
+		glog.Warningf("%s: no overlay for cluster %q, using the base configuration", file, cluster)
+	}
+	return mergeConfig(&l.Base, overlay)
+}
+
+// isLayeredConfig reports whether the YAML document in data has base or overlays at the top
+func isLayeredConfig(data []byte) bool {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil || len(root.Content) == 0 {
+		return false
+	}
+	for _, key := range []string{"base", "overlays"} {
+		if value, _ := yamlMapValue(root.Content[0], key); value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixConfigErrors returns errs with prefix added to the path of each configError
+func prefixConfigErrors(prefix string, errs []error) []error {
+	for i, err := range errs {
+		var cfgErr *configError
+		if errors.As(err, &cfgErr) {
+			errs[i] = configErrorf(prefix+"."+cfgErr.path, "%s", cfgErr.msg)
+		} else {
+			errs[i] = fmt.Errorf("%s: %w", prefix, err)
+		}
+	}
+	return errs
+}
@@ -8,28 +8,34 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/golang/glog"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if err := runSchema(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	var parameters WhSvrParameters
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
-	flag.StringVar(&parameters.envCfgFile, "envCfgFile", "/etc/webhook/config/envconfig.yaml", "File containing the mutation configuration.")
+	flag.StringVar(&parameters.envCfgFile, "envCfgFile", "/etc/webhook/config", "File containing the mutation configuration, or directory of *.yaml files merged in lexical order.")
+	flag.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Path to a kubeconfig, only required when running outside the cluster.")
+	flag.StringVar(&parameters.configKey, "configPublicKey", "", "File containing the PEM encoded ed25519 or cosign public key, which can instead be given itself in $CONFIG_PUBLIC_KEY. When set, the -envCfgFile file must have a matching detached signature in <file>.sig, or the directory one of its SHA256SUMS manifest in SHA256SUMS.sig. Only -envCfgFile is verified: EnvInjectionPolicy resources and team override ConfigMaps are not signed.")
+	flag.StringVar(&parameters.cluster, "cluster", os.Getenv("CLUSTER_NAME"), "Name of the cluster, selecting the overlay of layered configuration files. Defaults to $CLUSTER_NAME.")
 	flag.Parse()
 
-	envConfig, err := loadConfig(parameters.envCfgFile)
-	if err != nil {
-		glog.Errorf("Error loading configuration: %v", err)
-	}
-
 	whsvr := &WebhookServer{
-		envConfig: envConfig,
 		server: &http.Server{
 			Addr: fmt.Sprintf(":%v", parameters.port),
 			TLSConfig: &tls.Config{
@@ -43,11 +49,50 @@ func main() {
 				},
 			},
 		},
+		cluster: parameters.cluster,
+	}
+
+	if parameters.configKey != "" {
+		key, err := loadConfigPublicKey(parameters.configKey)
+		if err != nil {
+			glog.Fatalf("Error loading configuration public key: %v", err)
+		}
+		whsvr.configKey = key
+	} else if data := os.Getenv(configPublicKeyEnv); data != "" {
+		key, err := parseConfigPublicKey("$"+configPublicKeyEnv, []byte(data))
+		if err != nil {
+			glog.Fatalf("Error loading configuration public key: %v", err)
+		}
+		whsvr.configKey = key
+	}
+
+	// refuse to serve with a configuration that is invalid, rather than failing on the first request
+	if err := whsvr.reloadConfig(parameters.envCfgFile); err != nil {
+		glog.Fatalf("Error loading configuration: %v", err)
+	}
+	stopCh := make(chan struct{})
+
+	// cached lookups for when conditions, workload identity, injection policies and team overrides, mutation
+	// carries on without them if the cluster can't be reached
+	var waits []func()
+	client, dynamicClient, err := newKubeClients(parameters.kubeconfig)
+	if err != nil {
+		glog.Warningf("No Kubernetes client, namespaceObject will be null in when conditions, workload identity is skipped and policies and team overrides are not applied: %v", err)
+	} else {
+		whsvr.policies = newPolicyController(dynamicClient)
+		whsvr.policies.changed = whsvr.retainConditions
+		whsvr.overrides = newOverrideController(client, func() []string { return whsvr.config().AllowedOverrides })
+		whsvr.overrides.changed = whsvr.retainConditions
+		waits = append(waits, whsvr.startInformers(client, stopCh), whsvr.policies.start(stopCh), whsvr.overrides.start(client, stopCh))
+	}
+	if err := whsvr.watchConfig(parameters.envCfgFile, stopCh); err != nil {
+		glog.Warningf("Could not watch %s, configuration changes need a restart: %v", parameters.envCfgFile, err)
 	}
 
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", whsvr.serve)
+	mux.HandleFunc("/readyz", whsvr.readyz)
 	whsvr.server.Handler = mux
 
 	// start webhook server in new rountine
@@ -57,11 +102,26 @@ func main() {
 		}
 	}()
 
+	// the caches sync together while the webhook serves, readiness waits for them
+	go func() {
+		var wg sync.WaitGroup
+		for _, wait := range waits {
+			wg.Add(1)
+			go func(wait func()) {
+				defer wg.Done()
+				wait()
+			}(wait)
+		}
+		wg.Wait()
+		whsvr.ready.Store(true)
+	}()
+
 	// listening OS shutdown signal
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
 	glog.Infof("Got OS shutdown signal, shutting down env-injector-webhook server...")
+	close(stopCh)
 	whsvr.server.Shutdown(context.Background())
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mergeConfig returns base with overlay layered on top, leaving both untouched. List items replace the base item
+// with the same key and are otherwise appended:
+//   - env by name and when, dnsOptions by name, tolerations by key, effect and when, topologyConstraints by
+//     topologyKey and when, runtimeTuning by images, and node affinity terms by their content
+//   - removeEnv and allowedOverrides are the union of both lists, and patches are appended
+//
+// Map entries and the other fields set in overlay replace those in base, and removePodAntiAffinity is set when
+// either sets it.
+func mergeConfig(base, overlay *Config) *Config {
+	if base == nil {
+		base = &Config{}
+	}
+	if overlay == nil {
+		return base
+	}
+
+	merged := *base
+	merged.Env = mergeByKey(base.Env, overlay.Env, func(e EnvVar) string { return e.Name + "\x00" + e.When })
+	merged.RemoveEnv = mergeByKey(base.RemoveEnv, overlay.RemoveEnv, func(name string) string { return name })
+	merged.Downward = mergeMaps(base.Downward, overlay.Downward)
+	merged.RuntimeTuning = mergeByKey(base.RuntimeTuning, overlay.RuntimeTuning, func(r RuntimeTuningRule) string { return strings.Join(r.Images, "\x00") })
+	if overlay.Instrumentation.Java != nil {
+		merged.Instrumentation.Java = overlay.Instrumentation.Java
+	}
+	if overlay.OTel != nil {
+		merged.OTel = overlay.OTel
+	}
+	if overlay.TrustBundle != nil {
+		merged.TrustBundle = overlay.TrustBundle
+	}
+	if overlay.Proxy != nil {
+		merged.Proxy = overlay.Proxy
+	}
+	if overlay.Timezone != nil {
+		merged.Timezone = overlay.Timezone
+	}
+	if overlay.AzureWorkloadIdentity != nil {
+		merged.AzureWorkloadIdentity = overlay.AzureWorkloadIdentity
+	}
+	merged.DnsOptions = mergeByKey(base.DnsOptions, overlay.DnsOptions, func(o corev1.PodDNSConfigOption) string { return o.Name })
+	merged.RequiredNodeAffinityTerms = mergeByKey(base.RequiredNodeAffinityTerms, overlay.RequiredNodeAffinityTerms, jsonKey[NodeSelectorTerm])
+	merged.PreferredNodeAffinityTerms = mergeByKey(base.PreferredNodeAffinityTerms, overlay.PreferredNodeAffinityTerms, func(p PreferredSchedulingTerm) string {
+		return jsonKey(p.Preference) + "\x00" + p.When
+	})
+	merged.Tolerations = mergeByKey(base.Tolerations, overlay.Tolerations, func(t Toleration) string {
+		return t.Key + "\x00" + string(t.Effect) + "\x00" + t.When
+	})
+	merged.TopologyConstraints = mergeByKey(base.TopologyConstraints, overlay.TopologyConstraints, func(t TopologySpreadConstraint) string {
+		return t.TopologyKey + "\x00" + t.When
+	})
+	merged.RemovePodAntiAffinity = base.RemovePodAntiAffinity || overlay.RemovePodAntiAffinity
+	if overlay.AutomountServiceAccountToken != nil {
+		merged.AutomountServiceAccountToken = overlay.AutomountServiceAccountToken
+	}
+	merged.Defaults = mergeMaps(base.Defaults, overlay.Defaults)
+	if len(overlay.Patches) > 0 {
+		merged.Patches = append(append([]PodPatch{}, base.Patches...), overlay.Patches...)
+	}
+	merged.AllowedOverrides = mergeByKey(base.AllowedOverrides, overlay.AllowedOverrides, func(name string) string { return name })
+	return &merged
+}
+
+// mergeByKey returns base with each overlay item replacing the base item with the same key, or appended
+func mergeByKey[T any](base, overlay []T, key func(T) string) []T {
+	if len(overlay) == 0 {
+		return base
+	}
+	merged := append([]T{}, base...)
+	for _, item := range overlay {
+		k := key(item)
+		replaced := false
+		for i := range merged {
+			if key(merged[i]) == k {
+				merged[i] = item
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// mergeMaps returns the entries of both maps, those in overlay replacing those in base
+func mergeMaps[V any](base, overlay map[string]V) map[string]V {
+	if len(overlay) == 0 {
+		return base
+	}
+	merged := make(map[string]V, len(base)+len(overlay))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overlay {
+		merged[k] = v
+	}
+	return merged
+}
+
+// jsonKey identifies items without a natural key by their content
+func jsonKey[T any](item T) string {
+	data, _ := json.Marshal(item)
+	return string(data)
+}
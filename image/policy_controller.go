@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	policyGroup   = "env-injector.hmcts.net"
+	policyVersion = "v1alpha1"
+
+	policyConditionReady = "Ready"
+	policyReasonValid    = "Valid"
+	policyReasonInvalid  = "InvalidSpec"
+	policyValidMessage   = "Policy is applied to matching pods"
+	policyStatusTimeout  = 10 * time.Second
+	policyPriorityField  = "priority"
+)
+
+var (
+	// envInjectionPolicyGVR is the cluster scoped policy, applied to pods in every namespace
+	envInjectionPolicyGVR = schema.GroupVersionResource{Group: policyGroup, Version: policyVersion, Resource: "envinjectionpolicies"}
+	// namespacedEnvInjectionPolicyGVR is the namespaced policy, applied to pods in its own namespace only
+	namespacedEnvInjectionPolicyGVR = schema.GroupVersionResource{Group: policyGroup, Version: policyVersion, Resource: "namespacedenvinjectionpolicies"}
+)
+
+// injectionPolicy is a valid EnvInjectionPolicy or NamespacedEnvInjectionPolicy
+type injectionPolicy struct {
+	namespace string
+	name      string
+	priority  int64
+	config    *Config
+}
+
+// policyController keeps the valid injection policies in the cluster, and reports on each policy whether it is
+// valid through its Ready status condition
+type policyController struct {
+	client dynamic.Interface
+
+	mu       sync.RWMutex
+	policies map[string]injectionPolicy // by resource and namespace/name
+	changed  func()                     // called once the policies have changed, when set
+}
+
+func newPolicyController(client dynamic.Interface) *policyController {
+	return &policyController{client: client, policies: map[string]injectionPolicy{}}
+}
+
+// start watches both policy kinds. The returned func waits for the initial sync, which gives up after
+// informerSyncTimeout as when the CustomResourceDefinitions are not installed.
+func (pc *policyController) start(stopCh <-chan struct{}) func() {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(pc.client, informerResyncPeriod)
+	for _, gvr := range []schema.GroupVersionResource{envInjectionPolicyGVR, namespacedEnvInjectionPolicyGVR} {
+		gvr := gvr
+		factory.ForResource(gvr).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { pc.sync(gvr, obj) },
+			UpdateFunc: func(_, obj interface{}) { pc.sync(gvr, obj) },
+			DeleteFunc: func(obj interface{}) {
+				if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+					pc.remove(gvr, key)
+				}
+			},
+		})
+	}
+	factory.Start(stopCh)
+	return func() { waitForCacheSync(factory.WaitForCacheSync, stopCh, "policies will be missing") }
+}
+
+// sync validates the policy, keeps it when it is valid and drops it when it is not, and records the outcome in its
+// status
+func (pc *policyController) sync(gvr schema.GroupVersionResource, obj interface{}) {
+	policy, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key := gvr.Resource + "/" + cacheKey(policy)
+
+	cfg, priority, err := decodePolicy(policy)
+	pc.mu.Lock()
+	if err != nil {
+		delete(pc.policies, key)
+	} else {
+		pc.policies[key] = injectionPolicy{namespace: policy.GetNamespace(), name: policy.GetName(), priority: priority, config: cfg}
+	}
+	pc.mu.Unlock()
+	pc.notify()
+
+	condition := metav1.Condition{Type: policyConditionReady, Status: metav1.ConditionTrue, Reason: policyReasonValid, Message: policyValidMessage}
+	if err != nil {
+		glog.Errorf("Ignoring %s %s: %v", policy.GetKind(), cacheKey(policy), err)
+		condition = metav1.Condition{Type: policyConditionReady, Status: metav1.ConditionFalse, Reason: policyReasonInvalid, Message: err.Error()}
+	}
+	if err := pc.updateStatus(gvr, policy, condition); err != nil {
+		glog.Warningf("Could not update the status of %s %s: %v", policy.GetKind(), cacheKey(policy), err)
+	}
+}
+
+func (pc *policyController) remove(gvr schema.GroupVersionResource, key string) {
+	pc.mu.Lock()
+	delete(pc.policies, gvr.Resource+"/"+key)
+	pc.mu.Unlock()
+	pc.notify()
+}
+
+func (pc *policyController) notify() {
+	if pc.changed != nil {
+		pc.changed()
+	}
+}
+
+// configs returns the configuration of every valid policy
+func (pc *policyController) configs() []*Config {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	configs := make([]*Config, 0, len(pc.policies))
+	for _, policy := range pc.policies {
+		configs = append(configs, policy.config)
+	}
+	return configs
+}
+
+// updateStatus sets the condition on the policy, skipping the update when the status already says so, as every
+// update comes back through the informer
+func (pc *policyController) updateStatus(gvr schema.GroupVersionResource, policy *unstructured.Unstructured, condition metav1.Condition) error {
+	var status struct {
+		ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+		Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	}
+	if raw, ok := policy.Object["status"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err != nil {
+			return err
+		}
+	}
+
+	condition.ObservedGeneration = policy.GetGeneration()
+	if current := meta.FindStatusCondition(status.Conditions, condition.Type); current != nil && status.ObservedGeneration == policy.GetGeneration() &&
+		current.Status == condition.Status && current.Reason == condition.Reason && current.Message == condition.Message && current.ObservedGeneration == condition.ObservedGeneration {
+		return nil
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+	status.ObservedGeneration = policy.GetGeneration()
+
+	raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return err
+	}
+	updated := policy.DeepCopy()
+	updated.Object["status"] = raw
+
+	ctx, cancel := context.WithTimeout(context.Background(), policyStatusTimeout)
+	defer cancel()
+	_, err = pc.client.Resource(gvr).Namespace(policy.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+// configFor returns base with the cluster policies, then the policies in the namespace, layered on top in order of
+// priority. Policies of equal priority are applied in order of name.
+func (pc *policyController) configFor(base *Config, namespace string) *Config {
+	pc.mu.RLock()
+	var policies []injectionPolicy
+	for _, policy := range pc.policies {
+		if policy.namespace == "" || policy.namespace == namespace {
+			policies = append(policies, policy)
+		}
+	}
+	pc.mu.RUnlock()
+
+	sort.Slice(policies, func(i, j int) bool {
+		a, b := policies[i], policies[j]
+		if (a.namespace == "") != (b.namespace == "") {
+			return a.namespace == ""
+		}
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		return a.name < b.name
+	})
+	for _, policy := range policies {
+		base = mergeConfig(base, policy.config)
+	}
+	return base
+}
+
+// decodePolicy validates the spec of the policy, which holds a priority alongside the fields of the configuration
+// file
+func decodePolicy(policy *unstructured.Unstructured) (*Config, int64, error) {
+	spec, _, err := unstructured.NestedMap(policy.Object, "spec")
+	if err != nil {
+		return nil, 0, err
+	}
+	priority, _, err := unstructured.NestedInt64(spec, policyPriorityField)
+	if err != nil {
+		return nil, 0, err
+	}
+	delete(spec, policyPriorityField)
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, 0, err
+	}
+	// decode it as YAML so problems are reported against the lines of the spec as kubectl shows it
+	if data, err = yaml.JSONToYAML(data); err != nil {
+		return nil, 0, err
+	}
+	cfg, err := decodeConfig("spec", data)
+	if err != nil {
+		return nil, 0, errors.New(strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	if len(cfg.AllowedOverrides) > 0 {
+		return nil, 0, errors.New("allowedOverrides can only be set in the configuration file")
+	}
+	return cfg, priority, nil
+}
+
+// cacheKey returns namespace/name, or name for cluster scoped objects
+func cacheKey(obj metav1.Object) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// removeEnv performs the mutation(s) needed to remove the environment variables matching any of the names from
+// the target resource. A name ending in * matches every variable with that prefix. It also returns the variables
+// left behind so later mutations can index into them.
+func removeEnv(target []corev1.EnvVar, names []string, basePath string) (remaining []corev1.EnvVar, patch []patchOperation) {
+	// remove from the end so earlier indices stay valid as the patch is applied
+	for idx := len(target) - 1; idx >= 0; idx-- {
+		if envNameMatches(target[idx].Name, names) {
+			patch = append(patch, patchOperation{
+				Op:   "remove",
+				Path: fmt.Sprintf("%s/%d", basePath, idx),
+			})
+		}
+	}
+	for _, envVar := range target {
+		if !envNameMatches(envVar.Name, names) {
+			remaining = append(remaining, envVar)
+		}
+	}
+	return remaining, patch
+}
+
+// envNameMatches reports whether name is one of the names, or starts with one ending in *
+func envNameMatches(name string, names []string) bool {
+	for _, n := range names {
+		if prefix, ok := strings.CutSuffix(n, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == n {
+			return true
+		}
+	}
+	return false
+}
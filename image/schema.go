@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"k8s-env-injector/config/v1alpha2"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// jsonSchema is the subset of JSON Schema draft-07 the generated schemas use
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	AnyOf                []*jsonSchema          `json:"anyOf,omitempty"`
+	Definitions          map[string]*jsonSchema `json:"definitions,omitempty"`
+}
+
+// chartConfigValues are the chart values rendered as is into the configuration file
+var chartConfigValues = []string{
+	"allowedOverrides", "automountServiceAccountToken", "azureWorkloadIdentity", "defaults", "downward",
+	"instrumentation", "otel", "patches", "preferredNodeAffinityTerms", "proxy", "removeEnv",
+	"removePodAntiAffinity", "requiredNodeAffinityTerms", "runtimeTuning", "timezone", "tolerations",
+	"topologyConstraints", "trustBundle",
+}
+
+// runSchema implements the schema subcommand, writing the JSON Schema of the configuration file, of the values of
+// the Helm chart or of a policy CustomResourceDefinition to out
+func runSchema(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	fs.SetOutput(out)
+	values := fs.Bool("values", false, "Write the schema of the Helm chart values, values.schema.json, instead of the configuration file.")
+	crd := fs.String("crd", "", "Write the CustomResourceDefinition of the policy kind, EnvInjectionPolicy or NamespacedEnvInjectionPolicy, instead of the configuration file.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *crd != "" {
+		return writePolicyCRD(*crd, out)
+	}
+	schema := configSchema()
+	if *values {
+		schema = valuesSchema()
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+// configSchema returns the schema of an env-injector.hmcts.net/v1alpha2 configuration file, flat or layered
+func configSchema() *jsonSchema {
+	g := schemaGenerator{definitions: map[string]*jsonSchema{}}
+	flat := g.schemaFor(reflect.TypeOf(v1alpha2.EnvInjectorConfig{}))
+	layered := g.schemaFor(reflect.TypeOf(v1alpha2.LayeredEnvInjectorConfig{}))
+	for _, name := range []string{"EnvInjectorConfig", "LayeredEnvInjectorConfig"} {
+		def := g.definitions[name]
+		def.Properties["apiVersion"] = &jsonSchema{Type: "string", Enum: []string{configAPIVersionV1alpha2}}
+		def.Properties["kind"] = &jsonSchema{Type: "string", Enum: []string{configKind}}
+	}
+	return &jsonSchema{Schema: jsonSchemaDraft, AnyOf: []*jsonSchema{flat, layered}, Definitions: g.definitions}
+}
+
+// valuesSchema returns the schema of the values of the env-injector-webhook chart. The values rendered into the
+// configuration file take their schema from the v1alpha2 Config, and the other values are those the templates use.
+func valuesSchema() *jsonSchema {
+	g := schemaGenerator{definitions: map[string]*jsonSchema{}}
+	config := g.schemaFor(reflect.TypeOf(v1alpha2.Config{}))
+	configProperties := g.definitions[strings.TrimPrefix(config.Ref, "#/definitions/")].Properties
+
+	str := &jsonSchema{Type: "string"}
+	properties := map[string]*jsonSchema{
+		"image":               str,
+		"replicas":            {Type: "integer"},
+		"nameOverride":        str,
+		"fullnameOverride":    str,
+		"cluster":             str,
+		"extraConfigMaps":     {Type: "array", Items: str},
+		"environment":         {Type: "object", AdditionalProperties: &jsonSchema{Type: []string{"string", "number", "boolean"}}},
+		"keyVaultEnvironment": {Type: "object", AdditionalProperties: g.schemaFor(reflect.TypeOf(v1alpha2.KeyVaultRef{}))},
+		"dnsOptions":          {Type: "object", AdditionalProperties: &jsonSchema{Type: []string{"string", "number", "null"}}},
+		"configSigning": {Type: "object", AdditionalProperties: false, Properties: map[string]*jsonSchema{
+			"publicKey": str,
+		}},
+	}
+	for _, name := range chartConfigValues {
+		properties[name] = configProperties[name]
+	}
+	schema := &jsonSchema{Schema: jsonSchemaDraft, Type: "object", Properties: properties}
+	schema.Definitions = g.referenced(schema)
+	return schema
+}
+
+// referenced returns the definitions schema refers to, directly or through other definitions
+func (g *schemaGenerator) referenced(schema *jsonSchema) map[string]*jsonSchema {
+	definitions := map[string]*jsonSchema{}
+	var walk func(*jsonSchema)
+	walk = func(s *jsonSchema) {
+		if s == nil {
+			return
+		}
+		if name := strings.TrimPrefix(s.Ref, "#/definitions/"); s.Ref != "" && definitions[name] == nil {
+			definitions[name] = g.definitions[name]
+			walk(g.definitions[name])
+		}
+		for _, p := range s.Properties {
+			walk(p)
+		}
+		if additional, ok := s.AdditionalProperties.(*jsonSchema); ok {
+			walk(additional)
+		}
+		walk(s.Items)
+		for _, a := range s.AnyOf {
+			walk(a)
+		}
+	}
+	walk(schema)
+	return definitions
+}
+
+// schemaGenerator builds schemas from Go types the way encoding/json, and so ghodss/yaml, decodes them. Named
+// structs become definitions, and keys that match no field are not allowed, as with unknownConfigKeys.
+type schemaGenerator struct {
+	definitions map[string]*jsonSchema
+}
+
+var quantityType = reflect.TypeOf(resource.Quantity{})
+
+func (g *schemaGenerator) schemaFor(t reflect.Type) *jsonSchema {
+	if t.Kind() == reflect.Pointer {
+		return nullable(g.schemaFor(t.Elem()))
+	}
+	if t == quantityType {
+		return &jsonSchema{AnyOf: []*jsonSchema{{Type: "number"}, {Type: "string"}}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.String:
+		// ghodss/yaml decodes any scalar into a string, e.g. the 3 of ndots
+		return &jsonSchema{Type: []string{"string", "number", "boolean"}}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := g.definitions[name]; !ok {
+			def := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}, AdditionalProperties: false}
+			// registered before the fields, so recursive types refer back to it
+			g.definitions[name] = def
+			g.addProperties(def, t)
+		}
+		return &jsonSchema{Ref: "#/definitions/" + name}
+	default:
+		// interface{} takes any value
+		return &jsonSchema{}
+	}
+}
+
+// addProperties adds the fields of struct type t to def, including those of embedded structs that are not
+// shadowed by an outer one
+func (g *schemaGenerator) addProperties(def *jsonSchema, t reflect.Type) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			embedded = append(embedded, f.Type)
+		case f.IsExported():
+			if name == "" {
+				name = f.Name
+			}
+			def.Properties[name] = g.schemaFor(f.Type)
+		}
+	}
+	for _, e := range embedded {
+		inner := &jsonSchema{Properties: map[string]*jsonSchema{}}
+		g.addProperties(inner, e)
+		for name, schema := range inner.Properties {
+			if _, ok := def.Properties[name]; !ok {
+				def.Properties[name] = schema
+			}
+		}
+	}
+}
+
+// schemaName names the definition of t after its package, as the Kubernetes OpenAPI does, e.g.
+// io.k8s.api.core.v1.EnvVarSource. The types of the configuration file keep their plain name.
+func schemaName(t reflect.Type) string {
+	if t.PkgPath() == reflect.TypeOf(v1alpha2.Config{}).PkgPath() {
+		return t.Name()
+	}
+	parts := strings.Split(t.PkgPath(), "/")
+	domain := strings.Split(parts[0], ".")
+	slices.Reverse(domain)
+	return strings.Join(append(append(domain, parts[1:]...), t.Name()), ".")
+}
+
+// nullable lets schema also take null, which pointer fields decode as nil
+func nullable(schema *jsonSchema) *jsonSchema {
+	if schema.Ref == "" && schema.AnyOf == nil {
+		copied := *schema
+		switch typ := schema.Type.(type) {
+		case string:
+			copied.Type = []string{typ, "null"}
+			return &copied
+		case []string:
+			copied.Type = append(append([]string{}, typ...), "null")
+			return &copied
+		}
+	}
+	return &jsonSchema{AnyOf: []*jsonSchema{schema, {Type: "null"}}}
+}
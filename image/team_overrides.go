@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// teamOverrideLabel marks a ConfigMap as a team override for the pods in its namespace
+	teamOverrideLabel = "env-injector.hmcts.net/override"
+	// teamOverrideKey is the ConfigMap key holding the override, in the format of the configuration file
+	teamOverrideKey = "envconfig.yaml"
+
+	teamOverrideComponent     = "env-injector-webhook"
+	teamOverrideReasonInvalid = "InvalidOverride"
+	teamOverrideReasonIgnored = "IgnoredOverrideFields"
+)
+
+// teamOverride is a valid team override ConfigMap
+type teamOverride struct {
+	name   string
+	config *Config
+}
+
+// overrideController keeps the valid team override ConfigMaps by namespace. Problems with an override are
+// logged and recorded as events on its ConfigMap, as teams do not get to read the webhook logs.
+type overrideController struct {
+	allowed  func() []string
+	recorder record.EventRecorder
+
+	mu        sync.RWMutex
+	overrides map[string]map[string]teamOverride // by namespace, then name
+	changed   func()                             // called once the overrides have changed, when set
+}
+
+// newOverrideController returns a controller that reports fields outside the current allowed() as ignored
+func newOverrideController(client kubernetes.Interface, allowed func() []string) *overrideController {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &overrideController{
+		allowed:   allowed,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: teamOverrideComponent}),
+		overrides: map[string]map[string]teamOverride{},
+	}
+}
+
+// start watches the labelled ConfigMaps in every namespace. The returned func waits for the initial sync, see
+// waitForCacheSync.
+func (oc *overrideController) start(client kubernetes.Interface, stopCh <-chan struct{}) func() {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, informerResyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = teamOverrideLabel + "=true"
+		}))
+	factory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { oc.sync(obj) },
+		UpdateFunc: func(old, obj interface{}) {
+			// resyncs deliver unchanged objects, which would repeat the events
+			if old.(*corev1.ConfigMap).ResourceVersion != obj.(*corev1.ConfigMap).ResourceVersion {
+				oc.sync(obj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				oc.remove(cm.Namespace, cm.Name)
+			}
+		},
+	})
+	factory.Start(stopCh)
+	return func() { waitForCacheSync(factory.WaitForCacheSync, stopCh, "team overrides will be missing") }
+}
+
+// sync validates the override, keeps it when it is valid and drops it when it is not
+func (oc *overrideController) sync(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+	cfg, err := decodeTeamOverride(cm)
+	if err != nil {
+		glog.Errorf("Ignoring team override %s/%s: %v", cm.Namespace, cm.Name, err)
+		oc.recorder.Event(cm, corev1.EventTypeWarning, teamOverrideReasonInvalid, err.Error())
+		oc.remove(cm.Namespace, cm.Name)
+		return
+	}
+	if ignored := disallowedFields(cfg, oc.allowed()); len(ignored) > 0 {
+		glog.Warningf("Ignoring fields of team override %s/%s that are not in allowedOverrides: %s", cm.Namespace, cm.Name, strings.Join(ignored, ", "))
+		oc.recorder.Eventf(cm, corev1.EventTypeWarning, teamOverrideReasonIgnored, "Fields not allowed by the platform are ignored: %s", strings.Join(ignored, ", "))
+	}
+
+	oc.mu.Lock()
+	if oc.overrides[cm.Namespace] == nil {
+		oc.overrides[cm.Namespace] = map[string]teamOverride{}
+	}
+	oc.overrides[cm.Namespace][cm.Name] = teamOverride{name: cm.Name, config: cfg}
+	oc.mu.Unlock()
+	oc.notify()
+}
+
+func (oc *overrideController) remove(namespace, name string) {
+	oc.mu.Lock()
+	delete(oc.overrides[namespace], name)
+	if len(oc.overrides[namespace]) == 0 {
+		delete(oc.overrides, namespace)
+	}
+	oc.mu.Unlock()
+	oc.notify()
+}
+
+func (oc *overrideController) notify() {
+	if oc.changed != nil {
+		oc.changed()
+	}
+}
+
+// configs returns the configuration of every valid override
+func (oc *overrideController) configs() []*Config {
+	oc.mu.RLock()
+	defer oc.mu.RUnlock()
+	var configs []*Config
+	for _, overrides := range oc.overrides {
+		for _, override := range overrides {
+			configs = append(configs, override.config)
+		}
+	}
+	return configs
+}
+
+// configFor returns base with the overrides in the namespace layered on top in order of name, each restricted to
+// the fields in base.AllowedOverrides
+func (oc *overrideController) configFor(base *Config, namespace string) *Config {
+	if len(base.AllowedOverrides) == 0 {
+		return base
+	}
+	oc.mu.RLock()
+	overrides := make([]teamOverride, 0, len(oc.overrides[namespace]))
+	for _, override := range oc.overrides[namespace] {
+		overrides = append(overrides, override)
+	}
+	oc.mu.RUnlock()
+
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].name < overrides[j].name })
+	allowed := base.AllowedOverrides
+	for _, override := range overrides {
+		base = mergeConfig(base, restrictConfig(override.config, allowed))
+	}
+	return base
+}
+
+// decodeTeamOverride validates the override held by the ConfigMap
+func decodeTeamOverride(cm *corev1.ConfigMap) (*Config, error) {
+	data, ok := cm.Data[teamOverrideKey]
+	if !ok {
+		return nil, fmt.Errorf("no %s key", teamOverrideKey)
+	}
+	cfg, err := decodeConfig(teamOverrideKey, []byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s", strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	if len(cfg.AllowedOverrides) > 0 {
+		return nil, fmt.Errorf("allowedOverrides can only be set in the configuration file")
+	}
+	return cfg, nil
+}
+
+// restrictConfig returns cfg with only the top level fields named in allowed
+func restrictConfig(cfg *Config, allowed []string) *Config {
+	var restricted Config
+	src, dst := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(&restricted).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if slices.Contains(allowed, configFieldName(src.Type().Field(i))) {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return &restricted
+}
+
+// disallowedFields returns the top level fields set in cfg that are not named in allowed
+func disallowedFields(cfg *Config, allowed []string) (fields []string) {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := configFieldName(v.Type().Field(i))
+		if !v.Field(i).IsZero() && !slices.Contains(allowed, name) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// configFieldName returns the name of a Config field in the configuration file
+func configFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	yamlv3 "gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// configError is a problem with the value at path in the configuration, e.g. env[2].mode
+type configError struct {
+	path string
+	msg  string
+}
+
+func (e *configError) Error() string {
+	return e.path + ": " + e.msg
+}
+
+func configErrorf(path, format string, args ...interface{}) error {
+	return &configError{path: path, msg: fmt.Sprintf(format, args...)}
+}
+
+// decodeStrict decodes the configuration held in file into out. On top of the usual decoding, keys must match a
+// field exactly, as encoding/json would otherwise drop unknown keys and match miscased ones. The problems with the
+// keys, and those returned by validate once decoded, are all reported with their line in file.
+func decodeStrict(file string, data []byte, out interface{}, validate func() []error) error {
+	if err := unmarshalYAML(data, out); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	var errs []error
+	if len(root.Content) > 0 {
+		errs = append(errs, unknownConfigKeys(root.Content[0], reflect.TypeOf(out), "")...)
+	}
+	errs = append(errs, validate()...)
+
+	for i, err := range errs {
+		var cfgErr *configError
+		if errors.As(err, &cfgErr) {
+			errs[i] = fmt.Errorf("%s:%d: %w", file, configLine(&root, cfgErr.path), err)
+		} else {
+			errs[i] = fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// unmarshalYAML is yaml.Unmarshal, except that the embedded structs of a struct embedding others are each
+// decoded from data on their own. ghodss/yaml only converts values, e.g. a number for a string field, for the
+// fields declared on the struct itself, and fails on those of embedded structs. The versioned configuration file
+// types embed their parts and declare no fields of their own.
+func unmarshalYAML(data []byte, out interface{}) error {
+	v := reflect.ValueOf(out).Elem()
+	var embedded []reflect.Value
+	if v.Kind() == reflect.Struct {
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.Anonymous && f.IsExported() && f.Type.Kind() == reflect.Struct {
+				embedded = append(embedded, v.Field(i).Addr())
+			}
+		}
+	}
+	if len(embedded) == 0 {
+		return yaml.Unmarshal(data, out)
+	}
+	for _, part := range embedded {
+		if err := unmarshalYAML(data, part.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unwrapErrors returns the errors joined in err
+func unwrapErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// unknownConfigKeys walks the YAML node alongside the type it decodes into, and reports the keys that match no
+// field exactly or are repeated. Values of the wrong kind are left for the decoder to report.
+func unknownConfigKeys(node *yamlv3.Node, t reflect.Type, path string) (errs []error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yamlv3.AliasNode {
+		node = node.Alias
+	}
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		if node.Kind != yamlv3.MappingNode {
+			return nil
+		}
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			if seen[key] {
+				errs = append(errs, configErrorf(keyPath, "duplicate field"))
+				continue
+			}
+			seen[key] = true
+			elem := t
+			if t.Kind() == reflect.Map {
+				elem = t.Elem()
+			} else if elem = fields[key]; elem == nil {
+				errs = append(errs, configErrorf(keyPath, "unknown field"))
+				continue
+			}
+			errs = append(errs, unknownConfigKeys(node.Content[i+1], elem, keyPath)...)
+		}
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yamlv3.SequenceNode {
+			return nil
+		}
+		for i, item := range node.Content {
+			errs = append(errs, unknownConfigKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return errs
+}
+
+// jsonFields returns the types of the fields of struct type t by their JSON name, including the fields of
+// embedded structs that are not shadowed by an outer one
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			embedded = append(embedded, f.Type)
+		case f.IsExported():
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = f.Type
+		}
+	}
+	for _, e := range embedded {
+		for name, ft := range jsonFields(e) {
+			if _, ok := fields[name]; !ok {
+				fields[name] = ft
+			}
+		}
+	}
+	return fields
+}
+
+// configLine returns the line of the YAML node at path, e.g. env[2].mode, or of the closest parent found when
+// the path does not resolve all the way
+func configLine(root *yamlv3.Node, path string) int {
+	node := root
+	if node.Kind == yamlv3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, segment := range strings.Split(path, ".") {
+		key, indexes := segment, []int(nil)
+		if open := strings.Index(segment, "["); open >= 0 {
+			key = segment[:open]
+			for _, index := range strings.Split(strings.Trim(segment[open:], "[]"), "][") {
+				i, err := strconv.Atoi(index)
+				if err != nil {
+					return line
+				}
+				indexes = append(indexes, i)
+			}
+		}
+		if key != "" {
+			value, keyLine := yamlMapValue(node, key)
+			if value == nil {
+				return line
+			}
+			node, line = value, keyLine
+		}
+		for _, i := range indexes {
+			if node.Kind != yamlv3.SequenceNode || i >= len(node.Content) {
+				return line
+			}
+			node = node.Content[i]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+// yamlMapValue returns the value under key in the YAML mapping node and the line of the key, or nil. A key
+// that only matches ignoring case is accepted, as the decoder has already reported it and used its value.
+func yamlMapValue(node *yamlv3.Node, key string) (*yamlv3.Node, int) {
+	if node.Kind != yamlv3.MappingNode {
+		return nil, 0
+	}
+	match := -1
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			match = i
+			break
+		}
+		if match < 0 && strings.EqualFold(node.Content[i].Value, key) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, 0
+	}
+	return node.Content[match+1], node.Content[match].Line
+}
+
+// validateConfig checks the parts of the configuration that cannot be caught while unmarshalling it, returning
+// every problem found
+func validateConfig(cfg *Config) error {
+	var errs []error
+	for i, e := range cfg.Env {
+		errs = append(errs, validateEnvVar(fmt.Sprintf("env[%d]", i), e)...)
+	}
+	for i, name := range cfg.RemoveEnv {
+		if strings.TrimSuffix(name, "*") == "" {
+			errs = append(errs, configErrorf(fmt.Sprintf("removeEnv[%d]", i), "name must not be empty"))
+		}
+	}
+	for i, rule := range cfg.RuntimeTuning {
+		p := fmt.Sprintf("runtimeTuning[%d]", i)
+		if len(rule.Images) == 0 {
+			errs = append(errs, configErrorf(p+".images", "must not be empty"))
+		}
+		if rule.JavaMaxRAMPercentage < 0 || rule.JavaMaxRAMPercentage > 100 || rule.NodeMaxOldSpacePercentage < 0 || rule.NodeMaxOldSpacePercentage > 100 {
+			errs = append(errs, configErrorf(p, "percentages must be between 0 and 100"))
+		}
+	}
+	if java := cfg.Instrumentation.Java; java != nil {
+		if java.Image == "" || java.AgentPath == "" || len(java.Images) == 0 {
+			errs = append(errs, configErrorf("instrumentation.java", "image, agentPath and images are required"))
+		}
+		if java.Resources != nil {
+			errs = append(errs, validateResources("instrumentation.java.resources", java.Resources)...)
+		}
+	}
+	if tb := cfg.TrustBundle; tb != nil && (tb.ConfigMap == "") == (tb.Secret == "") {
+		errs = append(errs, configErrorf("trustBundle", "exactly one of configMap or secret is required"))
+	}
+	if proxy := cfg.Proxy; proxy != nil {
+		if proxy.HTTPProxy == "" && proxy.HTTPSProxy == "" {
+			errs = append(errs, configErrorf("proxy", "httpProxy or httpsProxy is required"))
+		}
+		for i, cidr := range proxy.ClusterCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				errs = append(errs, configErrorf(fmt.Sprintf("proxy.clusterCIDRs[%d]", i), "%v", err))
+			}
+		}
+	}
+	if tz := cfg.Timezone; tz != nil {
+		if tz.Name == "" {
+			errs = append(errs, configErrorf("timezone", "name is required"))
+		}
+		if tz.ConfigMap != "" && tz.HostPath != "" {
+			errs = append(errs, configErrorf("timezone", "at most one of configMap or hostPath may be set"))
+		}
+		if tz.HostPath != "" && !path.IsAbs(tz.HostPath) {
+			errs = append(errs, configErrorf("timezone.hostPath", "%q must be absolute", tz.HostPath))
+		}
+	}
+	if wi := cfg.AzureWorkloadIdentity; wi != nil && wi.TokenExpirationSeconds != 0 && wi.TokenExpirationSeconds < minServiceAccountTokenLifetime {
+		errs = append(errs, configErrorf("azureWorkloadIdentity.tokenExpirationSeconds", "must be at least %d", minServiceAccountTokenLifetime))
+	}
+	errs = append(errs, validateDnsOptions(cfg.DnsOptions)...)
+	for i, t := range cfg.Tolerations {
+		errs = append(errs, validateToleration(fmt.Sprintf("tolerations[%d]", i), t.Toleration)...)
+	}
+	for i, term := range cfg.RequiredNodeAffinityTerms {
+		errs = append(errs, validateNodeSelectorTerm(fmt.Sprintf("requiredNodeAffinityTerms[%d]", i), term.NodeSelectorTerm)...)
+	}
+	for i, term := range cfg.PreferredNodeAffinityTerms {
+		p := fmt.Sprintf("preferredNodeAffinityTerms[%d]", i)
+		if term.Weight < 1 || term.Weight > 100 {
+			errs = append(errs, configErrorf(p+".weight", "must be between 1 and 100"))
+		}
+		errs = append(errs, validateNodeSelectorTerm(p+".preference", term.Preference)...)
+	}
+	for i, c := range cfg.TopologyConstraints {
+		errs = append(errs, validateTopologySpreadConstraint(fmt.Sprintf("topologyConstraints[%d]", i), c.TopologySpreadConstraint)...)
+	}
+	fields := jsonFields(reflect.TypeOf(*cfg))
+	for i, name := range cfg.AllowedOverrides {
+		if _, ok := fields[name]; !ok || name == "allowedOverrides" {
+			errs = append(errs, configErrorf(fmt.Sprintf("allowedOverrides[%d]", i), "unknown field %q", name))
+		}
+	}
+	for i, patch := range cfg.Patches {
+		errs = append(errs, validatePodPatch(fmt.Sprintf("patches[%d]", i), patch)...)
+	}
+	keys := make([]string, 0, len(cfg.Defaults))
+	for key := range cfg.Defaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := defaultPathSegments(key); err != nil {
+			errs = append(errs, configErrorf("defaults", "%v", err))
+		} else if slices.Contains(serverDefaultedPaths, key) {
+			errs = append(errs, configErrorf("defaults", "%s is set by the API server before the webhook runs, so the default would never apply", key))
+		}
+	}
+	errs = append(errs, validateDownward(cfg.Downward)...)
+	errs = append(errs, validateConditions(cfg)...)
+	return errors.Join(errs...)
+}
+
+func validateEnvVar(p string, e EnvVar) (errs []error) {
+	for _, msg := range validation.IsEnvVarName(e.Name) {
+		errs = append(errs, configErrorf(p+".name", "invalid name %q: %s", e.Name, msg))
+	}
+	if e.Value != "" && e.ValueFrom != nil {
+		errs = append(errs, configErrorf(p, "value and valueFrom cannot both be set"))
+	}
+	switch e.Mode {
+	case "", envModeReplace, envModeAppend, envModePrepend:
+	default:
+		errs = append(errs, configErrorf(p+".mode", "unknown mode %q, expected %s, %s or %s", e.Mode, envModeReplace, envModeAppend, envModePrepend))
+	}
+	switch e.Position {
+	case "", envPositionLast, envPositionFirst, envPositionAuto:
+	default:
+		errs = append(errs, configErrorf(p+".position", "unknown position %q, expected %s, %s or %s", e.Position, envPositionLast, envPositionFirst, envPositionAuto))
+	}
+	if e.KeyVaultRef != nil {
+		errs = append(errs, validateKeyVaultRef(p, e)...)
+	}
+	return errs
+}
+
+// glibc caps resolver options at these values and silently clamps anything larger
+var dnsOptionLimits = map[string][2]int{
+	"ndots":    {0, 15},
+	"timeout":  {1, 30},
+	"attempts": {1, 5},
+}
+
+func validateDnsOptions(options []corev1.PodDNSConfigOption) (errs []error) {
+	seen := map[string]bool{}
+	for i, option := range options {
+		p := fmt.Sprintf("dnsOptions[%d]", i)
+		if option.Name == "" {
+			errs = append(errs, configErrorf(p+".name", "must not be empty"))
+			continue
+		}
+		if seen[option.Name] {
+			errs = append(errs, configErrorf(p+".name", "duplicate option %q", option.Name))
+		}
+		seen[option.Name] = true
+		limits, ok := dnsOptionLimits[option.Name]
+		if !ok {
+			continue
+		}
+		if option.Value == nil {
+			errs = append(errs, configErrorf(p+".value", "%s requires a value", option.Name))
+			continue
+		}
+		if value, err := strconv.Atoi(*option.Value); err != nil || value < limits[0] || value > limits[1] {
+			errs = append(errs, configErrorf(p+".value", "%s must be a whole number between %d and %d", option.Name, limits[0], limits[1]))
+		}
+	}
+	return errs
+}
+
+func validateToleration(p string, t corev1.Toleration) (errs []error) {
+	switch t.Operator {
+	case "", corev1.TolerationOpEqual:
+		if t.Key == "" {
+			errs = append(errs, configErrorf(p+".operator", "must be Exists when key is empty"))
+		}
+	case corev1.TolerationOpExists:
+		if t.Value != "" {
+			errs = append(errs, configErrorf(p+".value", "must be empty when operator is Exists"))
+		}
+	default:
+		errs = append(errs, configErrorf(p+".operator", "unknown operator %q, expected %s or %s", t.Operator, corev1.TolerationOpEqual, corev1.TolerationOpExists))
+	}
+	switch t.Effect {
+	case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		errs = append(errs, configErrorf(p+".effect", "unknown effect %q, expected %s, %s or %s", t.Effect, corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute))
+	}
+	if t.TolerationSeconds != nil && t.Effect != corev1.TaintEffectNoExecute {
+		errs = append(errs, configErrorf(p+".tolerationSeconds", "only applies to the %s effect", corev1.TaintEffectNoExecute))
+	}
+	return errs
+}
+
+func validateNodeSelectorTerm(p string, term corev1.NodeSelectorTerm) (errs []error) {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		errs = append(errs, configErrorf(p, "matchExpressions or matchFields is required"))
+	}
+	for i, req := range term.MatchExpressions {
+		errs = append(errs, validateNodeSelectorRequirement(fmt.Sprintf("%s.matchExpressions[%d]", p, i), req)...)
+	}
+	for i, req := range term.MatchFields {
+		rp := fmt.Sprintf("%s.matchFields[%d]", p, i)
+		// the scheduler only supports selecting a node by name through fields
+		if req.Key != "metadata.name" {
+			errs = append(errs, configErrorf(rp+".key", "unsupported field %q, expected metadata.name", req.Key))
+		}
+		if (req.Operator != corev1.NodeSelectorOpIn && req.Operator != corev1.NodeSelectorOpNotIn) || len(req.Values) != 1 {
+			errs = append(errs, configErrorf(rp, "must use In or NotIn with exactly one value"))
+		}
+	}
+	return errs
+}
+
+func validateNodeSelectorRequirement(p string, req corev1.NodeSelectorRequirement) (errs []error) {
+	if req.Key == "" {
+		errs = append(errs, configErrorf(p+".key", "must not be empty"))
+	}
+	switch req.Operator {
+	case corev1.NodeSelectorOpIn, corev1.NodeSelectorOpNotIn:
+		if len(req.Values) == 0 {
+			errs = append(errs, configErrorf(p+".values", "must not be empty for %s", req.Operator))
+		}
+	case corev1.NodeSelectorOpExists, corev1.NodeSelectorOpDoesNotExist:
+		if len(req.Values) > 0 {
+			errs = append(errs, configErrorf(p+".values", "must be empty for %s", req.Operator))
+		}
+	case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+		if len(req.Values) != 1 {
+			errs = append(errs, configErrorf(p+".values", "must hold exactly one value for %s", req.Operator))
+		} else if _, err := strconv.ParseInt(req.Values[0], 10, 64); err != nil {
+			errs = append(errs, configErrorf(p+".values", "%q must be an integer for %s", req.Values[0], req.Operator))
+		}
+	default:
+		errs = append(errs, configErrorf(p+".operator", "unknown operator %q, expected In, NotIn, Exists, DoesNotExist, Gt or Lt", req.Operator))
+	}
+	return errs
+}
+
+func validateTopologySpreadConstraint(p string, c corev1.TopologySpreadConstraint) (errs []error) {
+	if c.MaxSkew < 1 {
+		errs = append(errs, configErrorf(p+".maxSkew", "must be greater than zero"))
+	}
+	if c.TopologyKey == "" {
+		errs = append(errs, configErrorf(p+".topologyKey", "must not be empty"))
+	}
+	switch c.WhenUnsatisfiable {
+	case corev1.DoNotSchedule:
+	case corev1.ScheduleAnyway:
+		if c.MinDomains != nil {
+			errs = append(errs, configErrorf(p+".minDomains", "only applies when whenUnsatisfiable is %s", corev1.DoNotSchedule))
+		}
+	default:
+		errs = append(errs, configErrorf(p+".whenUnsatisfiable", "unknown value %q, expected %s or %s", c.WhenUnsatisfiable, corev1.DoNotSchedule, corev1.ScheduleAnyway))
+	}
+	return errs
+}
+
+// validateResources checks container resources as the API server would: quantities must not be negative, and a
+// request must not exceed the limit of the same resource
+func validateResources(path string, resources *corev1.ResourceRequirements) (errs []error) {
+	for _, list := range []struct {
+		name      string
+		resources corev1.ResourceList
+	}{{"limits", resources.Limits}, {"requests", resources.Requests}} {
+		names := make([]string, 0, len(list.resources))
+		for name := range list.resources {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			quantity := list.resources[corev1.ResourceName(name)]
+			if quantity.Sign() < 0 {
+				errs = append(errs, configErrorf(fmt.Sprintf("%s.%s.%s", path, list.name, name), "must not be negative"))
+			}
+			limit, ok := resources.Limits[corev1.ResourceName(name)]
+			if list.name == "requests" && ok && quantity.Cmp(limit) > 0 {
+				errs = append(errs, configErrorf(fmt.Sprintf("%s.requests.%s", path, name), "must be less than or equal to the %s limit", name))
+			}
+		}
+	}
+	return errs
+}
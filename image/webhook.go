@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 	v1 "k8s.io/api/admission/v1"
@@ -13,6 +17,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	corelisters "k8s.io/client-go/listers/core/v1"
 )
 
 var (
@@ -29,11 +34,38 @@ var ignoredNamespaces = []string{
 const (
 	admissionWebhookAnnotationInjectKey = "env-injector-webhook-inject"
 	admissionWebhookAnnotationStatusKey = "env-injector-webhook-status"
+	// admissionWebhookAnnotationAutomountKey lets a pod opt out of the automountServiceAccountToken default
+	admissionWebhookAnnotationAutomountKey = "env-injector-webhook-automount-token"
+)
+
+// EnvVar modes
+const (
+	envModeReplace = "replace"
+	envModeAppend  = "append"
+	envModePrepend = "prepend"
+)
+
+// EnvVar positions
+const (
+	envPositionLast  = "last"
+	envPositionFirst = "first"
+	envPositionAuto  = "auto"
 )
 
 type WebhookServer struct {
-	envConfig *Config
-	server    *http.Server
+	// mu guards the configuration, which is swapped whenever the file changes
+	mu              sync.RWMutex
+	envConfig       *Config
+	envConfigSum    [sha256.Size]byte
+	rejectedSum     [sha256.Size]byte
+	cluster         string           // selects the overlay of layered configuration files
+	configKey       crypto.PublicKey // verifies the signatures of the configuration files, when set
+	server          *http.Server
+	namespaces      corelisters.NamespaceLister
+	serviceAccounts corelisters.ServiceAccountLister
+	policies        *policyController
+	overrides       *overrideController
+	ready           atomic.Bool // set once the caches have synced, or given up, see readyz
 }
 
 // Webhook Server parameters
@@ -41,23 +73,183 @@ type WhSvrParameters struct {
 	port       int    // webhook server port
 	certFile   string // path to the x509 certificate for https
 	keyFile    string // path to the x509 private key matching `CertFile`
-	envCfgFile string // path to env injector configuration file
+	envCfgFile string // path to env injector configuration file or directory
+	kubeconfig string // path to a kubeconfig, only needed when running outside the cluster
+	cluster    string // name of the cluster, selecting the overlay of layered configuration files
+	configKey  string // path to the public key the configuration files must be signed with
 }
 
 type Config struct {
-	Env                        []corev1.EnvVar                   `yaml:"env"`
-	DnsOptions                 []corev1.PodDNSConfigOption       `yaml:"dnsOptions,omitempty"`
-	RequiredNodeAffinityTerms  []corev1.NodeSelectorTerm         `yaml:"requiredNodeAffinityTerms,omitempty"`
-	PreferredNodeAffinityTerms []corev1.PreferredSchedulingTerm  `yaml:"preferredNodeAffinityTerms,omitempty"`
-	Tolerations                []corev1.Toleration               `yaml:"tolerations,omitempty"`
-	TopologyConstraints        []corev1.TopologySpreadConstraint `yaml:"topologyConstraints,omitempty"`
-	RemovePodAntiAffinity      bool                              `yaml:"removePodAntiAffinity,omitempty"`
+	Env                          []EnvVar                    `yaml:"env" json:"env"`
+	RemoveEnv                    []string                    `yaml:"removeEnv,omitempty" json:"removeEnv,omitempty"`
+	Downward                     map[string]string           `yaml:"downward,omitempty" json:"downward,omitempty"`
+	RuntimeTuning                []RuntimeTuningRule         `yaml:"runtimeTuning,omitempty" json:"runtimeTuning,omitempty"`
+	Instrumentation              Instrumentation             `yaml:"instrumentation,omitempty" json:"instrumentation,omitempty"`
+	OTel                         *OpenTelemetry              `yaml:"otel,omitempty" json:"otel,omitempty"`
+	TrustBundle                  *TrustBundle                `yaml:"trustBundle,omitempty" json:"trustBundle,omitempty"`
+	Proxy                        *Proxy                      `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	Timezone                     *Timezone                   `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	AzureWorkloadIdentity        *AzureWorkloadIdentity      `yaml:"azureWorkloadIdentity,omitempty" json:"azureWorkloadIdentity,omitempty"`
+	DnsOptions                   []corev1.PodDNSConfigOption `yaml:"dnsOptions,omitempty" json:"dnsOptions,omitempty"`
+	RequiredNodeAffinityTerms    []NodeSelectorTerm          `yaml:"requiredNodeAffinityTerms,omitempty" json:"requiredNodeAffinityTerms,omitempty"`
+	PreferredNodeAffinityTerms   []PreferredSchedulingTerm   `yaml:"preferredNodeAffinityTerms,omitempty" json:"preferredNodeAffinityTerms,omitempty"`
+	Tolerations                  []Toleration                `yaml:"tolerations,omitempty" json:"tolerations,omitempty"`
+	TopologyConstraints          []TopologySpreadConstraint  `yaml:"topologyConstraints,omitempty" json:"topologyConstraints,omitempty"`
+	RemovePodAntiAffinity        bool                        `yaml:"removePodAntiAffinity,omitempty" json:"removePodAntiAffinity,omitempty"`
+	AutomountServiceAccountToken *bool                       `yaml:"automountServiceAccountToken,omitempty" json:"automountServiceAccountToken,omitempty"`
+	Defaults                     map[string]interface{}      `yaml:"defaults,omitempty" json:"defaults,omitempty"`
+	Patches                      []PodPatch                  `yaml:"patches,omitempty" json:"patches,omitempty"`
+	AllowedOverrides             []string                    `yaml:"allowedOverrides,omitempty" json:"allowedOverrides,omitempty"`
+}
+
+// The injected item types below wrap their Kubernetes counterparts with an optional CEL `when` expression.
+// The item is only injected when the expression, evaluated against `object` (the pod), `namespaceObject` and
+// `request`, is true.
+
+// EnvVar also takes a Mode. The default, replace, overwrites any value the container sets, while append and
+// prepend join the injected value onto it with Separator (a space unless set). Position controls where a
+// variable the container does not set is added: last (the default), first, or auto, which puts it just before
+// the first container variable that references it as $(NAME). KeyVaultRef takes the value from a Key Vault
+// secret instead of Value or ValueFrom.
+type EnvVar struct {
+	corev1.EnvVar `yaml:",inline"`
+	When          string       `yaml:"when,omitempty" json:"when,omitempty"`
+	Mode          string       `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Separator     string       `yaml:"separator,omitempty" json:"separator,omitempty"`
+	Position      string       `yaml:"position,omitempty" json:"position,omitempty"`
+	KeyVaultRef   *KeyVaultRef `yaml:"keyVaultRef,omitempty" json:"keyVaultRef,omitempty"`
+}
+
+// KeyVaultRef names a secret in an Azure Key Vault. The Secrets Store CSI driver syncs it into a Kubernetes
+// Secret through the SecretProviderClass named keyvault-<vault>, which must exist in the pod's namespace and
+// sync each Key Vault secret to the key of the same name in a Secret also named keyvault-<vault>.
+type KeyVaultRef struct {
+	Vault  string `yaml:"vault" json:"vault"`
+	Secret string `yaml:"secret" json:"secret"`
+}
+
+type Toleration struct {
+	corev1.Toleration `yaml:",inline"`
+	When              string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+type NodeSelectorTerm struct {
+	corev1.NodeSelectorTerm `yaml:",inline"`
+	When                    string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+type PreferredSchedulingTerm struct {
+	corev1.PreferredSchedulingTerm `yaml:",inline"`
+	When                           string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+type TopologySpreadConstraint struct {
+	corev1.TopologySpreadConstraint `yaml:",inline"`
+	When                            string `yaml:"when,omitempty" json:"when,omitempty"`
+}
+
+// RuntimeTuningRule sizes the runtime of containers whose image matches one of Images to their limits.
+// GoMaxProcs sets GOMAXPROCS to the CPU limit rounded up, JavaMaxRAMPercentage appends -XX:MaxRAMPercentage to
+// JAVA_TOOL_OPTIONS and NodeMaxOldSpacePercentage appends --max-old-space-size, as that percentage of the memory
+// limit, to NODE_OPTIONS.
+type RuntimeTuningRule struct {
+	Images                    []string `yaml:"images" json:"images"`
+	GoMaxProcs                bool     `yaml:"goMaxProcs,omitempty" json:"goMaxProcs,omitempty"`
+	JavaMaxRAMPercentage      float64  `yaml:"javaMaxRAMPercentage,omitempty" json:"javaMaxRAMPercentage,omitempty"`
+	NodeMaxOldSpacePercentage int      `yaml:"nodeMaxOldSpacePercentage,omitempty" json:"nodeMaxOldSpacePercentage,omitempty"`
+}
+
+// Instrumentation holds the language agents injected into matching containers
+type Instrumentation struct {
+	Java *JavaInstrumentation `yaml:"java,omitempty" json:"java,omitempty"`
+}
+
+// JavaInstrumentation loads the agent jar at AgentPath in Image into containers whose image matches one of
+// Images, by appending -javaagent to their JAVA_TOOL_OPTIONS. The jar is copied into an emptyDir mounted at
+// MountPath, so the agent can be upgraded without rebuilding every base image. Resources sets the requests and
+// limits of the init container that copies it, javaAgentResources by default.
+type JavaInstrumentation struct {
+	Image     string                       `yaml:"image" json:"image"`
+	AgentPath string                       `yaml:"agentPath" json:"agentPath"`
+	Images    []string                     `yaml:"images" json:"images"`
+	MountPath string                       `yaml:"mountPath,omitempty" json:"mountPath,omitempty"`
+	Resources *corev1.ResourceRequirements `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+// OpenTelemetry sets OTEL_SERVICE_NAME from the first of ServiceNameLabels set on the pod (app.kubernetes.io/name
+// then app by default), or its owner's name, and OTEL_RESOURCE_ATTRIBUTES from the pod's namespace, name, node
+// and container along with ClusterName and any extra ResourceAttributes.
+type OpenTelemetry struct {
+	ServiceNameLabels  []string          `yaml:"serviceNameLabels,omitempty" json:"serviceNameLabels,omitempty"`
+	ClusterName        string            `yaml:"clusterName,omitempty" json:"clusterName,omitempty"`
+	ResourceAttributes map[string]string `yaml:"resourceAttributes,omitempty" json:"resourceAttributes,omitempty"`
+}
+
+// TrustBundle mounts the CA bundle held in ConfigMap or Secret (under Key, ca.crt by default) into every
+// container at MountPath, and points SSL_CERT_FILE, NODE_EXTRA_CA_CERTS and REQUESTS_CA_BUNDLE at it. Java
+// cannot read a PEM bundle, so JAVA_TOOL_OPTIONS is only pointed at the PKCS12 trust store under
+// JavaTrustStoreKey when one is given. All but NODE_EXTRA_CA_CERTS replace the default trust store, so the
+// bundle must include the public roots too.
+type TrustBundle struct {
+	ConfigMap              string `yaml:"configMap,omitempty" json:"configMap,omitempty"`
+	Secret                 string `yaml:"secret,omitempty" json:"secret,omitempty"`
+	Key                    string `yaml:"key,omitempty" json:"key,omitempty"`
+	MountPath              string `yaml:"mountPath,omitempty" json:"mountPath,omitempty"`
+	JavaTrustStoreKey      string `yaml:"javaTrustStoreKey,omitempty" json:"javaTrustStoreKey,omitempty"`
+	JavaTrustStorePassword string `yaml:"javaTrustStorePassword,omitempty" json:"javaTrustStorePassword,omitempty"`
+}
+
+// Proxy points every container at the egress proxy. NO_PROXY is built from the cluster CIDRs, the in cluster
+// DNS suffixes and the pod's namespace, followed by NoProxy, and merged with any value the container sets.
+type Proxy struct {
+	HTTPProxy    string   `yaml:"httpProxy,omitempty" json:"httpProxy,omitempty"`
+	HTTPSProxy   string   `yaml:"httpsProxy,omitempty" json:"httpsProxy,omitempty"`
+	ClusterCIDRs []string `yaml:"clusterCIDRs,omitempty" json:"clusterCIDRs,omitempty"`
+	NoProxy      []string `yaml:"noProxy,omitempty" json:"noProxy,omitempty"`
+}
+
+// Timezone sets TZ to Name in every container. Libraries that read /etc/localtime rather than TZ are covered
+// by also mounting the zoneinfo file for Name there, either from ConfigMap (under Key, Name with / replaced by
+// _ by default) or from the zoneinfo directory at HostPath on the node.
+type Timezone struct {
+	Name      string `yaml:"name" json:"name"`
+	ConfigMap string `yaml:"configMap,omitempty" json:"configMap,omitempty"`
+	Key       string `yaml:"key,omitempty" json:"key,omitempty"`
+	HostPath  string `yaml:"hostPath,omitempty" json:"hostPath,omitempty"`
+}
+
+// AzureWorkloadIdentity sets pods up for Azure AD workload identity when their service account carries the
+// azure.workload.identity/client-id annotation. TenantID is used when the service account does not name its
+// own tenant, and the projected token lives for TokenExpirationSeconds (an hour by default).
+type AzureWorkloadIdentity struct {
+	TenantID               string `yaml:"tenantId,omitempty" json:"tenantId,omitempty"`
+	AuthorityHost          string `yaml:"authorityHost,omitempty" json:"authorityHost,omitempty"`
+	TokenExpirationSeconds int64  `yaml:"tokenExpirationSeconds,omitempty" json:"tokenExpirationSeconds,omitempty"`
+}
+
+// PodPatch is an escape hatch for pod fields the typed configuration does not cover. It holds either a raw
+// RFC 6902 operation against the pod or a strategic merge fragment against the pod spec, optionally guarded
+// by a test on whether a path exists.
+type PodPatch struct {
+	Op             string                 `yaml:"op,omitempty" json:"op,omitempty"`
+	Path           string                 `yaml:"path,omitempty" json:"path,omitempty"`
+	From           string                 `yaml:"from,omitempty" json:"from,omitempty"`
+	Value          interface{}            `yaml:"value,omitempty" json:"value,omitempty"`
+	StrategicMerge map[string]interface{} `yaml:"strategicMerge,omitempty" json:"strategicMerge,omitempty"`
+	Test           *PatchTest             `yaml:"test,omitempty" json:"test,omitempty"`
+}
+
+// PatchTest only lets a patch run when Path exists (or does not exist) on the pod
+type PatchTest struct {
+	Path   string `yaml:"path" json:"path"`
+	Exists bool   `yaml:"exists" json:"exists"`
 }
 
 type patchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
 	Value interface{} `json:"value,omitempty"`
+	From  string      `json:"from,omitempty"`
 }
 
 func init() {
@@ -78,6 +270,11 @@ func (whsvr *WebhookServer) mutate(ar *v1.AdmissionReview) *v1.AdmissionResponse
 		}
 	}
 
+	// the namespace is not always set on the object at admission time
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
 	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
 
@@ -89,8 +286,30 @@ func (whsvr *WebhookServer) mutate(ar *v1.AdmissionReview) *v1.AdmissionResponse
 		}
 	}
 
+	vars, err := conditionVariables(req, &pod, whsvr.namespaces)
+	if err != nil {
+		glog.Errorf("Could not build when condition variables: %v", err)
+		return &v1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	envConfig := whsvr.config()
+	if whsvr.policies != nil {
+		envConfig = whsvr.policies.configFor(envConfig, pod.Namespace)
+	}
+	if whsvr.overrides != nil {
+		envConfig = whsvr.overrides.configFor(envConfig, pod.Namespace)
+	}
+	var serviceAccount *corev1.ServiceAccount
+	if envConfig.AzureWorkloadIdentity != nil {
+		serviceAccount = lookupServiceAccount(whsvr.serviceAccounts, &pod)
+	}
+
 	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-	patchBytes, err := createPatch(&pod, whsvr.envConfig, annotations)
+	patchBytes, err := createPatch(&pod, envConfig, annotations, vars, serviceAccount)
 	if err != nil {
 		return &v1.AdmissionResponse{
 			Result: &metav1.Status{
@@ -110,6 +329,16 @@ func (whsvr *WebhookServer) mutate(ar *v1.AdmissionReview) *v1.AdmissionResponse
 	}
 }
 
+// readyz answers the readiness probe. The webhook serves while the caches sync, but only reports ready once they
+// have, so that a new pod takes requests when it can apply policies and team overrides.
+func (whsvr *WebhookServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if !whsvr.ready.Load() {
+		http.Error(w, "caches have not synced", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
 // serve manages requests to the webhook server
 func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	var body []byte
@@ -1,130 +1,164 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"k8s-env-injector/config/v1alpha1"
+	"k8s-env-injector/config/v1alpha2"
 )
 
 func TestLoadConfig(t *testing.T) {
 	ndotsVal := "3"
 	topologyHonorPolicy := corev1.NodeInclusionPolicyHonor
+	automountFalse := false
 	files := []struct {
 		name string
 		env  *Config
 	}{
 		{"test/env_test_1.yaml",
 			&Config{
-				[]corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
-				nil, nil, nil, nil, nil, false, // nil = empty tests, false for boolean not defined
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}}},
 			},
 		},
 		{"test/env_test_2.yaml",
 			&Config{
-				[]corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil},
-					{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}},
-				nil, nil, nil, nil, nil, false, // nil = empty tests, false for boolean not defined
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
+					{EnvVar: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}}},
 			},
 		},
 		{"test/env_test_3.yaml",
 			&Config{
-				[]corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil},
-					{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}},
-				[]corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
+					{EnvVar: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}}},
+				DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
 					{Name: "single-request-reopen", Value: nil},
 					{Name: "use-vc", Value: nil}},
-				nil, nil, nil, nil, false, // nil = empty tests, false for boolean not defined
 			},
 		},
 		{"test/env_test_4.yaml",
 			&Config{
-				[]corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil},
-					{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}},
-				[]corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
+					{EnvVar: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}}},
+				DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
 					{Name: "single-request-reopen", Value: nil},
 					{Name: "use-vc", Value: nil}},
-				[]corev1.NodeSelectorTerm{{
+				RequiredNodeAffinityTerms: []NodeSelectorTerm{{NodeSelectorTerm: corev1.NodeSelectorTerm{
 					MatchExpressions: []corev1.NodeSelectorRequirement{{
 						Key: "agentpool", Operator: corev1.NodeSelectorOpIn, Values: []string{"ubuntu18", "ubuntu1804"},
 					}},
-				}},
-				nil, nil, nil, false, // nil = empty tests, false for boolean not defined
+				}}},
 			},
 		},
 		{"test/env_test_5.yaml",
-			&Config{[]corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil},
-				{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}},
-				[]corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
+					{EnvVar: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}}},
+				DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
 					{Name: "single-request-reopen", Value: nil},
 					{Name: "use-vc", Value: nil}},
-				[]corev1.NodeSelectorTerm{{
+				RequiredNodeAffinityTerms: []NodeSelectorTerm{{NodeSelectorTerm: corev1.NodeSelectorTerm{
 					MatchExpressions: []corev1.NodeSelectorRequirement{{
 						Key: "agentpool", Operator: corev1.NodeSelectorOpIn, Values: []string{"ubuntu18", "ubuntu1804"},
 					}},
-				}},
-				[]corev1.PreferredSchedulingTerm{{
+				}}},
+				PreferredNodeAffinityTerms: []PreferredSchedulingTerm{{PreferredSchedulingTerm: corev1.PreferredSchedulingTerm{
 					Weight: 1,
 					Preference: corev1.NodeSelectorTerm{
 						MatchExpressions: []corev1.NodeSelectorRequirement{{
 							Key: "kubernetes.azure.com/scalesetpriority", Operator: corev1.NodeSelectorOpDoesNotExist,
 						}},
 					},
-				}},
-				nil, nil, false, // nil = empty tests, false for boolean not defined
+				}}},
 			},
 		},
 		{"test/env_test_6.yaml",
 			&Config{
-				[]corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil},
-					{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}},
-				[]corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
+					{EnvVar: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}}},
+				DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
 					{Name: "single-request-reopen", Value: nil},
 					{Name: "use-vc", Value: nil}},
-				[]corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
-					{Key: "agentpool", Operator: corev1.NodeSelectorOpIn, Values: []string{"ubuntu18", "ubuntu1804"}}}}},
-				[]corev1.PreferredSchedulingTerm{{
+				RequiredNodeAffinityTerms: []NodeSelectorTerm{{NodeSelectorTerm: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+					{Key: "agentpool", Operator: corev1.NodeSelectorOpIn, Values: []string{"ubuntu18", "ubuntu1804"}}}}}},
+				PreferredNodeAffinityTerms: []PreferredSchedulingTerm{{PreferredSchedulingTerm: corev1.PreferredSchedulingTerm{
 					Weight: 1,
 					Preference: corev1.NodeSelectorTerm{
 						MatchExpressions: []corev1.NodeSelectorRequirement{{
 							Key: "kubernetes.azure.com/scalesetpriority", Operator: corev1.NodeSelectorOpDoesNotExist,
 						}},
 					},
-				}},
-				[]corev1.Toleration{{
+				}}},
+				Tolerations: []Toleration{{Toleration: corev1.Toleration{
 					Key:      "kubernetes.azure.com/scalesetpriority",
 					Effect:   "NoSchedule",
 					Operator: "Equal",
 					Value:    "spot",
-				}},
-				nil, false, // nil = empty tests, false for boolean not defined
+				}}},
 			},
 		},
 		{"test/env_test_7.yaml",
 			&Config{
-				[]corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil},
-					{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}},
-				[]corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
+					{EnvVar: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-00", ValueFrom: nil}}},
+				DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndotsVal},
 					{Name: "single-request-reopen", Value: nil},
 					{Name: "use-vc", Value: nil}},
-				[]corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
-					{Key: "agentpool", Operator: corev1.NodeSelectorOpIn, Values: []string{"ubuntu18", "ubuntu1804"}}}}},
-				[]corev1.PreferredSchedulingTerm{{
+				RequiredNodeAffinityTerms: []NodeSelectorTerm{{NodeSelectorTerm: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+					{Key: "agentpool", Operator: corev1.NodeSelectorOpIn, Values: []string{"ubuntu18", "ubuntu1804"}}}}}},
+				PreferredNodeAffinityTerms: []PreferredSchedulingTerm{{PreferredSchedulingTerm: corev1.PreferredSchedulingTerm{
 					Weight: 1,
 					Preference: corev1.NodeSelectorTerm{
 						MatchExpressions: []corev1.NodeSelectorRequirement{{
 							Key: "kubernetes.azure.com/scalesetpriority", Operator: corev1.NodeSelectorOpDoesNotExist,
 						}},
 					},
-				}},
-				[]corev1.Toleration{{
+				}}},
+				Tolerations: []Toleration{{Toleration: corev1.Toleration{
 					Key:      "kubernetes.azure.com/scalesetpriority",
 					Effect:   "NoSchedule",
 					Operator: "Equal",
 					Value:    "spot",
-				}},
-				[]corev1.TopologySpreadConstraint{{
+				}}},
+				TopologyConstraints: []TopologySpreadConstraint{{TopologySpreadConstraint: corev1.TopologySpreadConstraint{
 					MaxSkew:            1,
 					TopologyKey:        "topology.kubernetes.io/zone",
 					NodeAffinityPolicy: &topologyHonorPolicy,
@@ -138,14 +172,139 @@ func TestLoadConfig(t *testing.T) {
 					MatchLabelKeys: []string{
 						"pod-template-hash",
 					},
+				}}},
+				RemovePodAntiAffinity: true,
+			},
+		},
+		{"test/env_test_8.yaml",
+			&Config{
+				Env:                          []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}}},
+				AutomountServiceAccountToken: &automountFalse,
+			},
+		},
+		{"test/env_test_9.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}}},
+				Patches: []PodPatch{
+					{Op: "add", Path: "/spec/enableServiceLinks", Value: false, Test: &PatchTest{Path: "/spec/enableServiceLinks", Exists: false}},
+					{StrategicMerge: map[string]interface{}{
+						"securityContext": map[string]interface{}{"runAsNonRoot": true},
+					}},
+				},
+			},
+		},
+		{"test/env_test_11.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+					{EnvVar: corev1.EnvVar{Name: "TIER", Value: "frontend"}, When: "object.metadata.labels['tier'] == 'frontend'"}},
+				Tolerations: []Toleration{{Toleration: corev1.Toleration{
+					Key:      "kubernetes.azure.com/scalesetpriority",
+					Effect:   "NoSchedule",
+					Operator: "Equal",
+					Value:    "spot",
+				}, When: "has(namespaceObject.metadata.labels) && namespaceObject.metadata.labels['spot'] == 'enabled'"}},
+			},
+		},
+		{"test/env_test_12.yaml",
+			&Config{
+				Env:       []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				RemoveEnv: []string{"APPINSIGHTS_INSTRUMENTATIONKEY", "http_proxy*"},
+			},
+		},
+		{"test/env_test_13.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:+UseContainerSupport"}, Mode: "append"},
+					{EnvVar: corev1.EnvVar{Name: "NO_PROXY", Value: ".cluster.local"}, Mode: "prepend", Separator: ","}},
+			},
+		},
+		{"test/env_test_14.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}, Position: "auto"},
+					{EnvVar: corev1.EnvVar{Name: "REGION", Value: "uksouth"}, Position: "first"}},
+			},
+		},
+		{"test/env_test_15.yaml",
+			&Config{
+				Env:      []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				Downward: map[string]string{"NODE_NAME": "spec.nodeName", "POD_IP": "status.podIP", "MEMORY_LIMIT": "limits.memory"},
+			},
+		},
+		{"test/env_test_16.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				RuntimeTuning: []RuntimeTuningRule{
+					{Images: []string{"*/golang-*"}, GoMaxProcs: true},
+					{Images: []string{"hmctspublic.azurecr.io/base/java:*"}, JavaMaxRAMPercentage: 75},
+					{Images: []string{"*node*"}, NodeMaxOldSpacePercentage: 75},
+				},
+			},
+		},
+		{"test/env_test_17.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				Instrumentation: Instrumentation{Java: &JavaInstrumentation{
+					Image:     "hmctspublic.azurecr.io/imported/applicationinsights-agent:3.5.1",
+					AgentPath: "/agent/applicationinsights-agent.jar",
+					Images:    []string{"*/java:*"},
 				}},
-				true,
+			},
+		},
+		{"test/env_test_18.yaml",
+			&Config{
+				Env:  []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				OTel: &OpenTelemetry{ClusterName: "aks-test-01", ResourceAttributes: map[string]string{"deployment.environment": "test"}},
+			},
+		},
+		{"test/env_test_19.yaml",
+			&Config{
+				Env:         []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				TrustBundle: &TrustBundle{ConfigMap: "corporate-ca", Key: "ca-bundle.pem", JavaTrustStoreKey: "truststore.p12"},
+			},
+		},
+		{"test/env_test_20.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				Proxy: &Proxy{
+					HTTPProxy:    "http://proxy.corp.example:3128",
+					HTTPSProxy:   "http://proxy.corp.example:3128",
+					ClusterCIDRs: []string{"10.244.0.0/16", "10.0.0.0/16"},
+					NoProxy:      []string{".corp.example"},
+				},
+			},
+		},
+		{"test/env_test_21.yaml",
+			&Config{
+				Env:      []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				Timezone: &Timezone{Name: "Europe/London", HostPath: "/usr/share/zoneinfo"},
+			},
+		},
+		{"test/env_test_22.yaml",
+			&Config{
+				Env:                   []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+				AzureWorkloadIdentity: &AzureWorkloadIdentity{TenantID: "72f988bf-86f1-41af-91ab-2d7cd011db47"},
+			},
+		},
+		{"test/env_test_23.yaml",
+			&Config{
+				Env: []EnvVar{
+					{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+					{EnvVar: corev1.EnvVar{Name: "DATABASE_PASSWORD"}, KeyVaultRef: &KeyVaultRef{Vault: "team-a-kv", Secret: "database-password"}},
+				},
+			},
+		},
+		{"test/env_test_10.yaml",
+			&Config{
+				Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}}},
+				Defaults: map[string]interface{}{
+					"spec.setHostnameAsFQDN":            true,
+					"spec.securityContext.runAsNonRoot": true,
+				},
 			},
 		},
 	}
 
 	for _, f := range files {
-		config, err := loadConfig(f.name)
+		config, _, err := loadConfig(f.name, "", nil)
 		if err != nil {
 			t.Errorf("Error loading file %s", f.name)
 			t.Fatal(err)
@@ -246,6 +405,14 @@ func TestAddEnv(t *testing.T) {
 				{Op: "replace", Path: "/spec/containers/nginx/env/1", Value: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-02", ValueFrom: nil}},
 			},
 		},
+		{
+			targetEnv: []corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-00", ValueFrom: nil}, {Name: "SUBSCRIPTION", Value: "subscription-01", ValueFrom: nil}},
+			sourceEnv: []corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}, {Name: "SUBSCRIPTION", Value: "subscription-01", ValueFrom: nil}},
+			path:      "/spec/containers/nginx/env",
+			patch: []patchOperation{
+				{Op: "replace", Path: "/spec/containers/nginx/env/0", Value: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01", ValueFrom: nil}},
+			},
+		},
 	}
 
 	for _, e := range envs {
@@ -1095,15 +1262,15 @@ func TestUpdateAnnotations(t *testing.T) {
 	}{
 		{map[string]string{"some-other-annotation": "some_value"},
 			map[string]string{admissionWebhookAnnotationStatusKey: "injected"},
-			[]patchOperation{{"add", "/metadata/annotations/" + admissionWebhookAnnotationStatusKey, "injected"}},
+			[]patchOperation{{Op: "add", Path: "/metadata/annotations/" + admissionWebhookAnnotationStatusKey, Value: "injected"}},
 		},
 		{nil,
 			map[string]string{admissionWebhookAnnotationStatusKey: "injected"},
-			[]patchOperation{{"add", "/metadata/annotations", map[string]string{admissionWebhookAnnotationStatusKey: "injected"}}},
+			[]patchOperation{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{admissionWebhookAnnotationStatusKey: "injected"}}},
 		},
 		{map[string]string{admissionWebhookAnnotationStatusKey: "some_value"},
 			map[string]string{admissionWebhookAnnotationStatusKey: "injected"},
-			[]patchOperation{{"replace", "/metadata/annotations/" + admissionWebhookAnnotationStatusKey, "injected"}},
+			[]patchOperation{{Op: "replace", Path: "/metadata/annotations/" + admissionWebhookAnnotationStatusKey, Value: "injected"}},
 		},
 	}
 
@@ -1133,3 +1300,2073 @@ func TestRemovePodAntiAffinity(t *testing.T) {
 		t.Errorf("removePodAntiAffinity was incorrect, for got: %v, want: %v.", expectedPatch, patch)
 	}
 }
+
+func TestAddAutomountServiceAccountToken(t *testing.T) {
+	automountTrue := true
+	automountFalse := false
+	tokens := []struct {
+		target    *bool
+		automount *bool
+		patch     []patchOperation
+	}{
+		{nil, &automountFalse, []patchOperation{{Op: "add", Path: "/spec/automountServiceAccountToken", Value: false}}},
+		{&automountTrue, &automountFalse, nil},
+		{&automountFalse, &automountTrue, nil},
+		{nil, nil, nil},
+	}
+
+	for _, tok := range tokens {
+		patch := addAutomountServiceAccountToken(tok.target, tok.automount, "/spec/automountServiceAccountToken")
+		if !cmp.Equal(patch, tok.patch) {
+			t.Errorf("addAutomountServiceAccountToken was incorrect, for %v, got: %v, want: %v.", tok.target, patch, tok.patch)
+		}
+	}
+}
+
+func TestRemoveServiceAccountTokenVolume(t *testing.T) {
+	// the pod as the ServiceAccount admission plugin hands it to the webhook
+	tokenMount := corev1.VolumeMount{Name: "kube-api-access-6x2ld", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount", ReadOnly: true}
+	newPod := func(automount *bool) *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{
+			AutomountServiceAccountToken: automount,
+			Volumes: []corev1.Volume{
+				{Name: "config"},
+				{Name: "kube-api-access-6x2ld", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{Path: "token"}}},
+				}}},
+			},
+			InitContainers: []corev1.Container{{Name: "migrate", VolumeMounts: []corev1.VolumeMount{tokenMount}}},
+			Containers: []corev1.Container{
+				{Name: "app", VolumeMounts: []corev1.VolumeMount{tokenMount, {Name: "config", MountPath: "/config"}}},
+				{Name: "sidecar", VolumeMounts: []corev1.VolumeMount{tokenMount}},
+			},
+		}}
+	}
+	automountTrue := true
+	automountFalse := false
+	localtime := corev1.VolumeMount{Name: timezoneVolumeName, MountPath: localtimePath, SubPath: "localtime", ReadOnly: true}
+	tests := []struct {
+		pod       *corev1.Pod
+		automount *bool
+		volumes   []string
+		init      []corev1.VolumeMount
+		app       []corev1.VolumeMount
+		sidecar   []corev1.VolumeMount
+	}{
+		{
+			pod:       newPod(nil),
+			automount: &automountFalse,
+			volumes:   []string{"config", timezoneVolumeName},
+			init:      []corev1.VolumeMount{},
+			app:       []corev1.VolumeMount{{Name: "config", MountPath: "/config"}, localtime},
+			sidecar:   []corev1.VolumeMount{localtime},
+		},
+		{
+			pod:       newPod(&automountTrue),
+			automount: &automountTrue,
+			volumes:   []string{"config", "kube-api-access-6x2ld", timezoneVolumeName},
+			init:      []corev1.VolumeMount{tokenMount},
+			app:       []corev1.VolumeMount{tokenMount, {Name: "config", MountPath: "/config"}, localtime},
+			sidecar:   []corev1.VolumeMount{tokenMount, localtime},
+		},
+	}
+
+	for _, tt := range tests {
+		config := &Config{AutomountServiceAccountToken: &automountFalse, Timezone: &Timezone{Name: "Europe/London", ConfigMap: "zoneinfo"}}
+		patchJSON, err := createPatch(tt.pod.DeepCopy(), config, map[string]string{}, nil, nil)
+		if err != nil {
+			t.Fatalf("createPatch failed: %v", err)
+		}
+		patch, err := jsonpatch.DecodePatch(patchJSON)
+		if err != nil {
+			t.Fatalf("createPatch returned an invalid patch: %v", err)
+		}
+		podJSON, _ := json.Marshal(tt.pod)
+		patchedJSON, err := patch.Apply(podJSON)
+		if err != nil {
+			t.Fatalf("Applying the patch failed: %v", err)
+		}
+		var patched corev1.Pod
+		if err := json.Unmarshal(patchedJSON, &patched); err != nil {
+			t.Fatal(err)
+		}
+
+		var volumes []string
+		for _, v := range patched.Spec.Volumes {
+			volumes = append(volumes, v.Name)
+		}
+		got := []interface{}{patched.Spec.AutomountServiceAccountToken, volumes, patched.Spec.InitContainers[0].VolumeMounts,
+			patched.Spec.Containers[0].VolumeMounts, patched.Spec.Containers[1].VolumeMounts}
+		want := []interface{}{tt.automount, tt.volumes, tt.init, tt.app, tt.sidecar}
+		if !cmp.Equal(got, want) {
+			t.Errorf("createPatch was incorrect, for automountServiceAccountToken %v, got: %v, want: %v.", tt.pod.Spec.AutomountServiceAccountToken, got, want)
+		}
+	}
+}
+
+func TestAnnotationOptOut(t *testing.T) {
+	annos := []struct {
+		annotations map[string]string
+		optOut      bool
+	}{
+		{nil, false},
+		{map[string]string{}, false},
+		{map[string]string{admissionWebhookAnnotationAutomountKey: "false"}, true},
+		{map[string]string{admissionWebhookAnnotationAutomountKey: "Off"}, true},
+		{map[string]string{admissionWebhookAnnotationAutomountKey: "true"}, false},
+		{map[string]string{admissionWebhookAnnotationInjectKey: "false"}, false},
+	}
+
+	for _, a := range annos {
+		optOut := annotationOptOut(a.annotations, admissionWebhookAnnotationAutomountKey)
+		if optOut != a.optOut {
+			t.Errorf("annotationOptOut was incorrect, for %v, got: %t, want: %t.", a.annotations, optOut, a.optOut)
+		}
+	}
+}
+
+func TestAddCustomPatches(t *testing.T) {
+	enableServiceLinks := true
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}}
+	podWithLinks := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}, EnableServiceLinks: &enableServiceLinks}}
+	addServiceLinks := PodPatch{Op: "add", Path: "/spec/enableServiceLinks", Value: false, Test: &PatchTest{Path: "/spec/enableServiceLinks", Exists: false}}
+	patches := []struct {
+		pod     corev1.Pod
+		applied []patchOperation
+		custom  []PodPatch
+		patch   []patchOperation
+	}{
+		{
+			pod:    pod,
+			custom: []PodPatch{addServiceLinks},
+			patch:  []patchOperation{{Op: "add", Path: "/spec/enableServiceLinks", Value: false}},
+		},
+		{
+			pod:    podWithLinks,
+			custom: []PodPatch{addServiceLinks},
+			patch:  nil,
+		},
+		{
+			pod: pod,
+			custom: []PodPatch{{StrategicMerge: map[string]interface{}{
+				"containers": []interface{}{map[string]interface{}{"name": "app", "imagePullPolicy": "Always"}},
+			}}},
+			patch: []patchOperation{{Op: "add", Path: "/spec/containers/0/imagePullPolicy", Value: "Always"}},
+		},
+		{
+			pod:    pod,
+			custom: []PodPatch{{StrategicMerge: map[string]interface{}{"securityContext": map[string]interface{}{"runAsNonRoot": true}}}},
+			patch:  []patchOperation{{Op: "add", Path: "/spec/securityContext", Value: map[string]interface{}{"runAsNonRoot": true}}},
+		},
+		{
+			// a patch that cannot be applied is skipped and the rest still run
+			pod: pod,
+			custom: []PodPatch{{Op: "remove", Path: "/spec/securityContext"}, {Op: "replace", Path: "/spec/missing/0", Value: "x"},
+				{Op: "add", Path: "/spec/hostname", Value: "app"}},
+			patch: []patchOperation{{Op: "add", Path: "/spec/hostname", Value: "app"}},
+		},
+		{
+			// the test sees tolerations added by the typed mutators
+			pod:     pod,
+			applied: []patchOperation{{Op: "add", Path: "/spec/tolerations", Value: []corev1.Toleration{{Key: "spot"}}}},
+			custom:  []PodPatch{{Op: "remove", Path: "/spec/tolerations", Test: &PatchTest{Path: "/spec/tolerations/0", Exists: true}}},
+			patch:   []patchOperation{{Op: "remove", Path: "/spec/tolerations"}},
+		},
+	}
+
+	for _, p := range patches {
+		original, _ := json.Marshal(p.pod)
+		patch, err := addCustomPatches(original, p.applied, p.custom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(patch, p.patch) {
+			t.Errorf("addCustomPatches was incorrect, for %v, got: %v, want: %v.", p.custom, patch, p.patch)
+		}
+	}
+}
+
+func TestJsonPointerExists(t *testing.T) {
+	doc := []byte(`{"spec":{"containers":[{"name":"app"}],"a/b":{"c~d":1},"nullField":null}}`)
+	pointers := []struct {
+		pointer string
+		exists  bool
+	}{
+		{"", true},
+		{"/spec/containers/0/name", true},
+		{"/spec/containers/1", false},
+		{"/spec/containers/x", false},
+		{"/spec/a~1b/c~0d", true},
+		{"/spec/nullField", false},
+		{"/spec/missing/deeper", false},
+	}
+
+	for _, p := range pointers {
+		exists, err := jsonPointerExists(doc, p.pointer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != p.exists {
+			t.Errorf("jsonPointerExists was incorrect, for %q, got: %t, want: %t.", p.pointer, exists, p.exists)
+		}
+	}
+}
+
+func TestAddDefaults(t *testing.T) {
+	setHostnameAsFQDN := false
+	runAsUser := int64(1000)
+	defaults := []struct {
+		pod      corev1.Pod
+		applied  []patchOperation
+		defaults map[string]interface{}
+		patch    []patchOperation
+	}{
+		{
+			pod:      corev1.Pod{},
+			defaults: map[string]interface{}{"spec.setHostnameAsFQDN": true},
+			patch:    []patchOperation{{Op: "add", Path: "/spec/setHostnameAsFQDN", Value: true}},
+		},
+		{
+			pod:      corev1.Pod{Spec: corev1.PodSpec{SetHostnameAsFQDN: &setHostnameAsFQDN}},
+			defaults: map[string]interface{}{"spec.setHostnameAsFQDN": true},
+			patch:    nil,
+		},
+		{
+			pod: corev1.Pod{},
+			defaults: map[string]interface{}{
+				"spec.securityContext.runAsNonRoot": true,
+				"spec.securityContext.runAsUser":    1000,
+			},
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/securityContext", Value: map[string]interface{}{"runAsNonRoot": true}},
+				{Op: "add", Path: "/spec/securityContext/runAsUser", Value: 1000},
+			},
+		},
+		{
+			pod: corev1.Pod{Spec: corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{RunAsUser: &runAsUser}}},
+			defaults: map[string]interface{}{
+				"spec.securityContext.runAsNonRoot": true,
+				"spec.securityContext.runAsUser":    0,
+			},
+			patch: []patchOperation{{Op: "add", Path: "/spec/securityContext/runAsNonRoot", Value: true}},
+		},
+		{
+			// a field already added by the typed mutators counts as set
+			pod:      corev1.Pod{},
+			applied:  []patchOperation{{Op: "add", Path: "/spec/automountServiceAccountToken", Value: true}},
+			defaults: map[string]interface{}{"spec.automountServiceAccountToken": false},
+			patch:    nil,
+		},
+		{
+			// a path that crosses a field which is not an object is skipped and the rest still apply
+			pod:      corev1.Pod{Spec: corev1.PodSpec{NodeName: "node-1"}},
+			defaults: map[string]interface{}{"spec.nodeName.nested": true, "spec.setHostnameAsFQDN": true},
+			patch:    []patchOperation{{Op: "add", Path: "/spec/setHostnameAsFQDN", Value: true}},
+		},
+	}
+
+	for _, d := range defaults {
+		original, _ := json.Marshal(d.pod)
+		patch, err := addDefaults(original, d.applied, d.defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(patch, d.patch) {
+			t.Errorf("addDefaults was incorrect, for %v, got: %v, want: %v.", d.defaults, patch, d.patch)
+		}
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"tier": "frontend"}}}
+	req := &v1.AdmissionRequest{Namespace: "rpe", UserInfo: authenticationv1.UserInfo{Username: "system:serviceaccount:rpe:deployer"}}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "rpe", Labels: map[string]string{"spot": "enabled"}}})
+
+	vars, err := conditionVariables(req, pod, corelisters.NewNamespaceLister(indexer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	varsWithoutNamespace, err := conditionVariables(req, pod, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conditions := []struct {
+		expr    string
+		vars    map[string]interface{}
+		matched bool
+	}{
+		{"", vars, true},
+		{"object.metadata.labels['tier'] == 'frontend'", vars, true},
+		{"object.metadata.labels['tier'] == 'backend'", vars, false},
+		{"object.metadata.labels['missing'] == 'x'", vars, false}, // evaluation errors do not match
+		{"namespaceObject.metadata.labels['spot'] == 'enabled'", vars, true},
+		{"namespaceObject != null && namespaceObject.metadata.labels['spot'] == 'enabled'", varsWithoutNamespace, false},
+		{"request.userInfo.username.startsWith('system:serviceaccount:rpe:')", vars, true},
+		{"request.namespace == 'rpe'", nil, false},
+	}
+
+	for _, c := range conditions {
+		matched := evaluateCondition(c.expr, c.vars)
+		if matched != c.matched {
+			t.Errorf("evaluateCondition was incorrect, for %q, got: %t, want: %t.", c.expr, matched, c.matched)
+		}
+	}
+}
+
+func TestValidateConditions(t *testing.T) {
+	configs := []struct {
+		cfg   *Config
+		valid bool
+	}{
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, When: "object.metadata.name == 'web'"}}}, true},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, When: "object.metadata.name =="}}}, false},
+		{&Config{Tolerations: []Toleration{{When: "1 + 1"}}}, false},
+		{&Config{TopologyConstraints: []TopologySpreadConstraint{{When: "unknownVar.x"}}}, false},
+	}
+
+	for _, c := range configs {
+		err := validateConditions(c.cfg)
+		if (err == nil) != c.valid {
+			t.Errorf("validateConditions was incorrect, for %v, got: %v, want valid: %t.", c.cfg, err, c.valid)
+		}
+	}
+}
+
+func TestSelectWhen(t *testing.T) {
+	vars := map[string]interface{}{
+		"object": map[string]interface{}{"metadata": map[string]interface{}{"labels": map[string]interface{}{"tier": "frontend"}}},
+	}
+	tolerations := []Toleration{
+		{Toleration: corev1.Toleration{Key: "always"}},
+		{Toleration: corev1.Toleration{Key: "frontend"}, When: "object.metadata.labels['tier'] == 'frontend'"},
+		{Toleration: corev1.Toleration{Key: "backend"}, When: "object.metadata.labels['tier'] == 'backend'"},
+	}
+	want := []corev1.Toleration{{Key: "always"}, {Key: "frontend"}}
+
+	selected := selectWhen[corev1.Toleration](tolerations, vars)
+	if !cmp.Equal(selected, want) {
+		t.Errorf("selectWhen was incorrect, got: %v, want: %v.", selected, want)
+	}
+}
+
+func TestConditionCostLimit(t *testing.T) {
+	items := make([]string, 200)
+	for i := range items {
+		items[i] = fmt.Sprint(i)
+	}
+	list := "[" + strings.Join(items, ", ") + "]"
+	// 200^3 iterations, far over conditionCostLimit
+	expr := fmt.Sprintf("%s.all(a, %s.all(b, %s.all(c, a + b + c >= 0)))", list, list, list)
+	prg, err := compileCondition(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]interface{}{"object": nil, "namespaceObject": nil, "request": nil}
+	if _, _, err := prg.Eval(vars); err == nil || !strings.Contains(err.Error(), "cost limit exceeded") {
+		t.Errorf("Eval was incorrect, got: %v, want: cost limit exceeded.", err)
+	}
+	if evaluateCondition(expr, nil) {
+		t.Errorf("evaluateCondition was incorrect, for an expression over the cost limit, got: %t, want: %t.", true, false)
+	}
+}
+
+func TestRetainConditions(t *testing.T) {
+	current := &Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, When: "request.namespace == 'team-a'"}}}
+	edited := &Config{Tolerations: []Toleration{{Toleration: corev1.Toleration{Key: "spot"}, When: "request.namespace == 'team-b'"}}}
+	for _, cfg := range []*Config{current, edited} {
+		if errs := validateConditions(cfg); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+	}
+
+	retainConditions(current)
+	conditionPrograms.RLock()
+	_, kept := conditionPrograms.programs["request.namespace == 'team-a'"]
+	_, dropped := conditionPrograms.programs["request.namespace == 'team-b'"]
+	conditionPrograms.RUnlock()
+	if !kept || dropped {
+		t.Errorf("retainConditions was incorrect, got kept: %t, dropped: %t, want kept: %t, dropped: %t.", kept, !dropped, true, true)
+	}
+	if !evaluateCondition("request.namespace == 'team-b'", map[string]interface{}{"request": map[string]interface{}{"namespace": "team-b"}}) {
+		t.Errorf("evaluateCondition was incorrect, got: %t for a dropped expression, want: %t.", false, true)
+	}
+}
+
+func TestRemoveEnv(t *testing.T) {
+	names := []string{"APPINSIGHTS_INSTRUMENTATIONKEY", "http_proxy*"}
+	envs := []struct {
+		targetEnv []corev1.EnvVar
+		remaining []corev1.EnvVar
+		patch     []patchOperation
+	}{
+		{
+			targetEnv: nil,
+			remaining: nil,
+			patch:     nil,
+		},
+		{
+			targetEnv: []corev1.EnvVar{{Name: "APP", Value: "1"}},
+			remaining: []corev1.EnvVar{{Name: "APP", Value: "1"}},
+			patch:     nil,
+		},
+		{
+			targetEnv: []corev1.EnvVar{{Name: "APPINSIGHTS_INSTRUMENTATIONKEY", Value: "key"}, {Name: "APP", Value: "1"}, {Name: "http_proxy_host", Value: "proxy"}},
+			remaining: []corev1.EnvVar{{Name: "APP", Value: "1"}},
+			patch: []patchOperation{
+				{Op: "remove", Path: "/spec/containers/0/env/2"},
+				{Op: "remove", Path: "/spec/containers/0/env/0"},
+			},
+		},
+		{
+			// names are matched exactly, only a trailing * matches a prefix
+			targetEnv: []corev1.EnvVar{{Name: "APPINSIGHTS_INSTRUMENTATIONKEY_OLD", Value: "key"}, {Name: "HTTP_PROXY", Value: "proxy"}},
+			remaining: []corev1.EnvVar{{Name: "APPINSIGHTS_INSTRUMENTATIONKEY_OLD", Value: "key"}, {Name: "HTTP_PROXY", Value: "proxy"}},
+			patch:     nil,
+		},
+	}
+
+	for _, e := range envs {
+		remaining, patch := removeEnv(e.targetEnv, names, "/spec/containers/0/env")
+		if !cmp.Equal(patch, e.patch) {
+			t.Errorf("removeEnv patch was incorrect, for %v, got: %v, want: %v.", e.targetEnv, patch, e.patch)
+		}
+		if !cmp.Equal(remaining, e.remaining) {
+			t.Errorf("removeEnv remaining was incorrect, for %v, got: %v, want: %v.", e.targetEnv, remaining, e.remaining)
+		}
+	}
+}
+
+func TestMergeEnvValues(t *testing.T) {
+	javaOpts := EnvVar{EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:+UseContainerSupport"}, Mode: envModeAppend}
+	noProxy := EnvVar{EnvVar: corev1.EnvVar{Name: "NO_PROXY", Value: ".cluster.local"}, Mode: envModePrepend, Separator: ","}
+	secretRef := &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{Key: "opts"}}
+	envs := []struct {
+		targetEnv []corev1.EnvVar
+		sourceEnv []EnvVar
+		merged    []corev1.EnvVar
+	}{
+		{
+			targetEnv: nil,
+			sourceEnv: []EnvVar{javaOpts, {EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+			merged:    []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:+UseContainerSupport"}, {Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+		},
+		{
+			targetEnv: []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xss1m"}, {Name: "NO_PROXY", Value: "localhost"}},
+			sourceEnv: []EnvVar{javaOpts, noProxy},
+			merged:    []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xss1m -XX:+UseContainerSupport"}, {Name: "NO_PROXY", Value: ".cluster.local,localhost"}},
+		},
+		{
+			// values already present are not added twice
+			targetEnv: []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:+UseContainerSupport -Xss1m"}},
+			sourceEnv: []EnvVar{javaOpts},
+			merged:    []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:+UseContainerSupport -Xss1m"}},
+		},
+		{
+			targetEnv: []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", ValueFrom: secretRef}},
+			sourceEnv: []EnvVar{javaOpts},
+			merged:    []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", ValueFrom: secretRef}},
+		},
+		{
+			targetEnv: []corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-00"}},
+			sourceEnv: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}, Mode: envModeReplace}},
+			merged:    []corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+		},
+		{
+			// entries for the same variable build on each other
+			targetEnv: []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xss1m"}},
+			sourceEnv: []EnvVar{javaOpts, {EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-javaagent:/agent.jar"}, Mode: envModeAppend}},
+			merged:    []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xss1m -XX:+UseContainerSupport -javaagent:/agent.jar"}},
+		},
+		{
+			targetEnv: nil,
+			sourceEnv: []EnvVar{javaOpts, {EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-javaagent:/agent.jar"}, Mode: envModeAppend}},
+			merged:    []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:+UseContainerSupport -javaagent:/agent.jar"}},
+		},
+	}
+
+	for _, e := range envs {
+		merged := mergeEnvValues(e.targetEnv, e.sourceEnv)
+		if !cmp.Equal(merged, e.merged) {
+			t.Errorf("mergeEnvValues was incorrect, for %v, got: %v, want: %v.", e.targetEnv, merged, e.merged)
+		}
+	}
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	ndots := "3"
+	want := &Config{
+		Env: []EnvVar{
+			{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+			{EnvVar: corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"}},
+			{EnvVar: corev1.EnvVar{Name: "OTEL_SERVICE_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['app']"}}}},
+		},
+		RemoveEnv:  []string{"OLD_PROXY_*"},
+		DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}},
+	}
+	cfg, _, err := loadConfig("test/env_config_dir", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(cfg, want) {
+		t.Errorf("loadConfig was incorrect, got: %v, want: %v.", cfg, want)
+	}
+
+	dir := t.TempDir()
+	if _, _, err := loadConfig(dir, "", nil); err == nil {
+		t.Errorf("loadConfig was incorrect, got no error for an empty directory")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00-env.yaml"), []byte("env:\n  - name: A\n    value: a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "10-dns.yaml"), []byte("dnsOptions:\n  - name: timeout\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, sum, err := loadConfig(dir, "", nil)
+	if wantErr := filepath.Join(dir, "10-dns.yaml") + ":2: dnsOptions[0].value: timeout requires a value"; err == nil || err.Error() != wantErr {
+		t.Errorf("loadConfig was incorrect, got: %v, want: %s.", err, wantErr)
+	}
+	var zero [len(sum)]byte
+	if sum == zero {
+		t.Errorf("loadConfig was incorrect, got no sum for an invalid directory")
+	}
+}
+
+func TestLoadLayeredConfig(t *testing.T) {
+	base := []Toleration{{Toleration: corev1.Toleration{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "apps", Effect: corev1.TaintEffectNoSchedule}}}
+	configs := []struct {
+		cluster string
+		want    *Config
+	}{
+		{"aks-test-01", &Config{
+			Env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+				{EnvVar: corev1.EnvVar{Name: "LOG_LEVEL", Value: "info"}},
+			},
+			Tolerations: append(base, Toleration{Toleration: corev1.Toleration{Key: "kubernetes.azure.com/scalesetpriority", Operator: corev1.TolerationOpEqual, Value: "spot", Effect: corev1.TaintEffectNoSchedule}}),
+		}},
+		{"aks-prod-01", &Config{
+			Env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-prod-01"}},
+				{EnvVar: corev1.EnvVar{Name: "LOG_LEVEL", Value: "info"}},
+			},
+			Tolerations: base,
+		}},
+		{"aks-other-01", &Config{
+			Env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "unknown"}},
+				{EnvVar: corev1.EnvVar{Name: "LOG_LEVEL", Value: "info"}},
+			},
+			Tolerations: base,
+		}},
+	}
+	for _, c := range configs {
+		cfg, _, err := loadConfig("test/env_test_layered.yaml", c.cluster, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(cfg, c.want) {
+			t.Errorf("loadConfig was incorrect, for %s got: %v, want: %v.", c.cluster, cfg, c.want)
+		}
+	}
+
+	if _, _, err := loadConfig("test/env_test_layered.yaml", "", nil); err == nil {
+		t.Errorf("loadConfig was incorrect, got no error without a cluster to select an overlay for")
+	}
+
+	file := filepath.Join(t.TempDir(), "envconfig.yaml")
+	data := "base:\n  env:\n    - name: A\n      value: a\noverlays:\n  aks-test-01:\n    env:\n      - name: A\n        mode: merge\n    tolerations:\n      - key: dedicated\n        operatr: Exists\nenv: []\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := loadConfig(file, "aks-test-01", nil)
+	if err == nil {
+		t.Fatalf("loadConfig was incorrect, got no error for %s", file)
+	}
+	want := []string{
+		file + `:12: overlays.aks-test-01.tolerations[0].operatr: unknown field`,
+		file + `:13: env: unknown field`,
+		file + `:9: overlays.aks-test-01.env[0].mode: unknown mode "merge", expected replace, append or prepend`,
+	}
+	if got := strings.Split(err.Error(), "\n"); !cmp.Equal(got, want) {
+		t.Errorf("loadConfig was incorrect, got: %q, want: %q.", got, want)
+	}
+}
+
+func TestLoadVersionedConfig(t *testing.T) {
+	ndots := "3"
+	want := &Config{
+		Env:        []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}},
+		DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}},
+	}
+	cfg, _, err := loadConfig("test/env_test_versioned.yaml", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(cfg, want) {
+		t.Errorf("loadConfig was incorrect, got: %v, want: %v.", cfg, want)
+	}
+
+	files := []struct {
+		data string
+		err  string
+	}{
+		{"apiVersion: env-injector.hmcts.net/v1alpha1\nkind: EnvInjectorConfig\nbase:\n  env:\n    - name: A\n      value: a\n", ""},
+		{"apiVersion: env-injector.hmcts.net/v2\nkind: EnvInjectorConfig\nenv: []\n", `envconfig.yaml:1: apiVersion: unsupported version "env-injector.hmcts.net/v2", expected one of [env-injector.hmcts.net/v1alpha1 env-injector.hmcts.net/v1alpha2]`},
+		{"apiVersion: env-injector.hmcts.net/v1alpha1\nkind: Config\nenv: []\n", `envconfig.yaml:2: kind: must be EnvInjectorConfig`},
+		{"kind: EnvInjectorConfig\nenv: []\n", `envconfig.yaml:1: apiVersion: is required with kind`},
+	}
+	for _, f := range files {
+		_, err := decodeConfigFile("envconfig.yaml", []byte(f.data), "")
+		if got := fmt.Sprint(err); (f.err == "" && err != nil) || (f.err != "" && got != f.err) {
+			t.Errorf("decodeConfigFile was incorrect, for %q got: %v, want: %s.", f.data, err, f.err)
+		}
+	}
+}
+
+func TestConvertV1alpha1(t *testing.T) {
+	data, err := os.ReadFile("test/env_test_v1alpha1.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in v1alpha1.EnvInjectorConfig
+	if err := unmarshalYAML(data, &in); err != nil {
+		t.Fatal(err)
+	}
+	// the fixture sets every field, so one missing from the conversion shows up in the round trip
+	v := reflect.ValueOf(in.Config)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("test/env_test_v1alpha1.yaml does not set %s", v.Type().Field(i).Name)
+		}
+	}
+
+	cfg := convertFromV1alpha1(&in.Config)
+	if out := convertToV1alpha1(cfg); !cmp.Equal(out, &in.Config) {
+		t.Errorf("convertToV1alpha1 did not round trip, got: %v, want: %v.", out, &in.Config)
+	}
+	if err := validateConfig(cfg); err != nil {
+		t.Errorf("test/env_test_v1alpha1.yaml is not valid: %v", err)
+	}
+	if loaded, _, err := loadConfig("test/env_test_v1alpha1.yaml", "", nil); err != nil || !cmp.Equal(loaded, cfg) {
+		t.Errorf("loadConfig was incorrect, got: %v, %v, want: %v.", loaded, err, cfg)
+	}
+}
+
+func TestConvertV1alpha2(t *testing.T) {
+	data, err := os.ReadFile("test/env_test_v1alpha2.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in v1alpha2.EnvInjectorConfig
+	if err := unmarshalYAML(data, &in); err != nil {
+		t.Fatal(err)
+	}
+	// the fixture sets every field, so one missing from the conversion shows up in the round trip
+	v := reflect.ValueOf(in.Config)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("test/env_test_v1alpha2.yaml does not set %s", v.Type().Field(i).Name)
+		}
+	}
+
+	cfg := convertFromV1alpha2(&in.Config)
+	if out := convertToV1alpha2(cfg); !cmp.Equal(out, &in.Config) {
+		t.Errorf("convertToV1alpha2 did not round trip, got: %v, want: %v.", out, &in.Config)
+	}
+	if err := validateConfig(cfg); err != nil {
+		t.Errorf("test/env_test_v1alpha2.yaml is not valid: %v", err)
+	}
+	if loaded, _, err := loadConfig("test/env_test_v1alpha2.yaml", "", nil); err != nil || !cmp.Equal(loaded, cfg) {
+		t.Errorf("loadConfig was incorrect, got: %v, %v, want: %v.", loaded, err, cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, _, err := loadConfig("test/env_test_invalid.yaml", "", nil)
+	if err == nil {
+		t.Fatal("loadConfig was incorrect, got no error for test/env_test_invalid.yaml")
+	}
+	want := []string{
+		`test/env_test_invalid.yaml:5: env[1].valu: unknown field`,
+		`test/env_test_invalid.yaml:10: RequiredNodeAffinityTerms: unknown field`,
+		`test/env_test_invalid.yaml:6: env[1].mode: unknown mode "merge", expected replace, append or prepend`,
+		`test/env_test_invalid.yaml:9: dnsOptions[0].value: ndots must be a whole number between 0 and 15`,
+		`test/env_test_invalid.yaml:17: tolerations[0].value: must be empty when operator is Exists`,
+		`test/env_test_invalid.yaml:12: requiredNodeAffinityTerms[0].matchExpressions[0].values: must not be empty for In`,
+	}
+	if got := strings.Split(err.Error(), "\n"); !cmp.Equal(got, want) {
+		t.Errorf("loadConfig was incorrect, got: %q, want: %q.", got, want)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	ndots := "5"
+	seconds := int64(60)
+	configs := []struct {
+		cfg   *Config
+		valid bool
+	}{
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, Mode: envModeAppend}}}, true},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, Mode: "merge"}}}, false},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A=B"}}}}, false},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A", Value: "a", ValueFrom: &corev1.EnvVarSource{}}}}}, false},
+		{&Config{DnsOptions: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}, {Name: "use-vc"}}}, true},
+		{&Config{DnsOptions: []corev1.PodDNSConfigOption{{Name: "timeout"}}}, false},
+		{&Config{DnsOptions: []corev1.PodDNSConfigOption{{Name: "use-vc"}, {Name: "use-vc"}}}, false},
+		{&Config{Tolerations: []Toleration{{Toleration: corev1.Toleration{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "batch", Effect: corev1.TaintEffectNoSchedule}}}}, true},
+		{&Config{Tolerations: []Toleration{{Toleration: corev1.Toleration{Key: "dedicated", Operator: "In"}}}}, false},
+		{&Config{Tolerations: []Toleration{{Toleration: corev1.Toleration{Operator: corev1.TolerationOpEqual, Value: "batch"}}}}, false},
+		{&Config{Tolerations: []Toleration{{Toleration: corev1.Toleration{Key: "dedicated", Effect: corev1.TaintEffectNoSchedule, TolerationSeconds: &seconds}}}}, false},
+		{&Config{RequiredNodeAffinityTerms: []NodeSelectorTerm{{NodeSelectorTerm: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "agentpool", Operator: corev1.NodeSelectorOpIn, Values: []string{"linux"}}}}}}}, true},
+		{&Config{RequiredNodeAffinityTerms: []NodeSelectorTerm{{NodeSelectorTerm: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "agentpool", Operator: corev1.NodeSelectorOpExists, Values: []string{"linux"}}}}}}}, false},
+		{&Config{RequiredNodeAffinityTerms: []NodeSelectorTerm{{NodeSelectorTerm: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "cores", Operator: corev1.NodeSelectorOpGt, Values: []string{"many"}}}}}}}, false},
+		{&Config{RequiredNodeAffinityTerms: []NodeSelectorTerm{{}}}, false},
+		{&Config{PreferredNodeAffinityTerms: []PreferredSchedulingTerm{{PreferredSchedulingTerm: corev1.PreferredSchedulingTerm{Weight: 0, Preference: corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node-1"}}}}}}}}, false},
+		{&Config{TopologyConstraints: []TopologySpreadConstraint{{TopologySpreadConstraint: corev1.TopologySpreadConstraint{MaxSkew: 1, TopologyKey: "topology.kubernetes.io/zone", WhenUnsatisfiable: corev1.ScheduleAnyway}}}}, true},
+		{&Config{TopologyConstraints: []TopologySpreadConstraint{{TopologySpreadConstraint: corev1.TopologySpreadConstraint{MaxSkew: 1, TopologyKey: "topology.kubernetes.io/zone", WhenUnsatisfiable: "Maybe"}}}}, false},
+		{&Config{Proxy: &Proxy{HTTPSProxy: "http://proxy:3128", ClusterCIDRs: []string{"10.0.0.0/16"}}}, true},
+		{&Config{Proxy: &Proxy{HTTPSProxy: "http://proxy:3128", ClusterCIDRs: []string{"10.0.0.0"}}}, false},
+		{&Config{Proxy: &Proxy{NoProxy: []string{".corp.example"}}}, false},
+		{&Config{Timezone: &Timezone{Name: "Europe/London", ConfigMap: "zoneinfo"}}, true},
+		{&Config{Timezone: &Timezone{Name: "Europe/London", ConfigMap: "zoneinfo", HostPath: "/usr/share/zoneinfo"}}, false},
+		{&Config{Timezone: &Timezone{Name: "Europe/London", HostPath: "zoneinfo"}}, false},
+		{&Config{AzureWorkloadIdentity: &AzureWorkloadIdentity{TokenExpirationSeconds: 60}}, false},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, KeyVaultRef: &KeyVaultRef{Vault: "team-a-kv", Secret: "a"}}}}, true},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, KeyVaultRef: &KeyVaultRef{Vault: "kv", Secret: "a"}}}}, false},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, KeyVaultRef: &KeyVaultRef{Vault: "team-a-kv", Secret: "a_b"}}}}, false},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A", Value: "a"}, KeyVaultRef: &KeyVaultRef{Vault: "team-a-kv", Secret: "a"}}}}, false},
+		{&Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "A"}, Mode: envModeAppend, KeyVaultRef: &KeyVaultRef{Vault: "team-a-kv", Secret: "a"}}}}, false},
+		{&Config{Instrumentation: Instrumentation{Java: &JavaInstrumentation{Image: "agent:3.5.1", AgentPath: "/agent.jar", Images: []string{"*"},
+			Resources: &corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("32Mi")}, Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}}}}}, true},
+		{&Config{Instrumentation: Instrumentation{Java: &JavaInstrumentation{Image: "agent:3.5.1", AgentPath: "/agent.jar", Images: []string{"*"},
+			Resources: &corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")}, Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}}}}}, false},
+		{&Config{Instrumentation: Instrumentation{Java: &JavaInstrumentation{Image: "agent:3.5.1", AgentPath: "/agent.jar", Images: []string{"*"},
+			Resources: &corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("-1")}}}}}, false},
+		{&Config{AllowedOverrides: []string{"env", "removeEnv"}}, true},
+		{&Config{AllowedOverrides: []string{"Env"}}, false},
+		{&Config{AllowedOverrides: []string{"allowedOverrides"}}, false},
+		{&Config{Patches: []PodPatch{{Op: "add", Path: "/metadata/labels/app.kubernetes.io~1part-of", Value: "platform"}, {Op: "move", From: "/spec/hostname", Path: "/spec/subdomain"}}}, true},
+		{&Config{Patches: []PodPatch{{StrategicMerge: map[string]interface{}{"enableServiceLinks": false}, Test: &PatchTest{Path: "/spec/enableServiceLinks"}}}}, true},
+		{&Config{Patches: []PodPatch{{Op: "insert", Path: "/spec/enableServiceLinks", Value: false}}}, false},
+		{&Config{Patches: []PodPatch{{Op: "add", Path: "spec/enableServiceLinks", Value: false}}}, false},
+		{&Config{Patches: []PodPatch{{Op: "add", Path: "/metadata/labels/a~b", Value: "c"}}}, false},
+		{&Config{Patches: []PodPatch{{Op: "remove"}}}, false},
+		{&Config{Patches: []PodPatch{{Op: "copy", Path: "/spec/subdomain"}}}, false},
+		{&Config{Patches: []PodPatch{{Op: "add", Path: "/spec/subdomain", From: "/spec/hostname"}}}, false},
+		{&Config{Patches: []PodPatch{{Op: "add", Path: "/spec/enableServiceLinks", StrategicMerge: map[string]interface{}{"enableServiceLinks": false}}}}, false},
+		{&Config{Patches: []PodPatch{{StrategicMerge: map[string]interface{}{}, Test: &PatchTest{Path: "spec"}}}}, false},
+		{&Config{Patches: []PodPatch{{StrategicMerge: map[string]interface{}{"containers": []interface{}{map[string]interface{}{"name": "app"}}}}}}, false},
+		{&Config{Patches: []PodPatch{{StrategicMerge: map[string]interface{}{"affinity": map[string]interface{}{"podAntiAffinity": map[string]interface{}{
+			"requiredDuringSchedulingIgnoredDuringExecution": []interface{}{}}}}}}}, true},
+		{&Config{Patches: []PodPatch{{StrategicMerge: map[string]interface{}{"securityContext": map[string]interface{}{"sysctls": []interface{}{}}}}}}, true},
+		{&Config{Defaults: map[string]interface{}{"spec.securityContext.runAsNonRoot": true, "metadata.labels.team": "a"}}, true},
+		{&Config{Defaults: map[string]interface{}{"spec..x": 1}}, false},
+		{&Config{Defaults: map[string]interface{}{"sepc.setHostnameAsFQDN": true}}, false},
+		{&Config{Defaults: map[string]interface{}{"spec.enableServiceLinks": false}}, false},
+		{&Config{Defaults: map[string]interface{}{"spec.securityContext": map[string]interface{}{"runAsNonRoot": true}}}, false},
+		{&Config{Defaults: map[string]interface{}{"spec": map[string]interface{}{}}}, false},
+		{&Config{Downward: map[string]string{"TEAM": "metadata.labels['app.kubernetes.io/part-of']", "HUGEPAGES": "limits.hugepages-2Mi", "HOST_IPS": "status.hostIPs"}}, true},
+		{&Config{Downward: map[string]string{"LABELS": "metadata.labels"}}, false},
+		{&Config{Downward: map[string]string{"TEAM": "metadata.labels[team]"}}, false},
+		{&Config{Downward: map[string]string{"PRIORITY": "spec.priority"}}, false},
+		{&Config{Downward: map[string]string{"PHASE": "status.phase"}}, false},
+		{&Config{Downward: map[string]string{"GPUS": "limits.nvidia.com/gpu"}}, false},
+	}
+
+	for _, c := range configs {
+		err := validateConfig(c.cfg)
+		if (err == nil) != c.valid {
+			t.Errorf("validateConfig was incorrect, for %v, got: %v, want valid: %t.", c.cfg, err, c.valid)
+		}
+	}
+}
+
+func TestInsertEnv(t *testing.T) {
+	cluster := EnvVar{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}, Position: envPositionAuto}
+	region := EnvVar{EnvVar: corev1.EnvVar{Name: "REGION", Value: "uksouth"}, Position: envPositionFirst}
+	zone := EnvVar{EnvVar: corev1.EnvVar{Name: "ZONE", Value: "1"}, Position: envPositionFirst}
+	subscription := EnvVar{EnvVar: corev1.EnvVar{Name: "SUBSCRIPTION", Value: "subscription-01"}}
+	envs := []struct {
+		targetEnv []corev1.EnvVar
+		sourceEnv []EnvVar
+		updated   []corev1.EnvVar
+		patch     []patchOperation
+		remaining []EnvVar
+	}{
+		{
+			targetEnv: []corev1.EnvVar{{Name: "APP", Value: "1"}},
+			sourceEnv: []EnvVar{subscription},
+			updated:   []corev1.EnvVar{{Name: "APP", Value: "1"}},
+			remaining: []EnvVar{subscription},
+		},
+		{
+			targetEnv: nil,
+			sourceEnv: []EnvVar{region, zone},
+			updated:   []corev1.EnvVar{region.EnvVar, zone.EnvVar},
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/env", Value: []corev1.EnvVar{region.EnvVar}},
+				{Op: "add", Path: "/spec/containers/0/env/1", Value: zone.EnvVar},
+			},
+		},
+		{
+			targetEnv: []corev1.EnvVar{{Name: "APP", Value: "1"}, {Name: "DB_HOST", Value: "db.$(CLUSTER_NAME).internal"}},
+			sourceEnv: []EnvVar{cluster, region, subscription},
+			updated:   []corev1.EnvVar{region.EnvVar, {Name: "APP", Value: "1"}, cluster.EnvVar, {Name: "DB_HOST", Value: "db.$(CLUSTER_NAME).internal"}},
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/env/0", Value: region.EnvVar},
+				{Op: "add", Path: "/spec/containers/0/env/2", Value: cluster.EnvVar},
+			},
+			remaining: []EnvVar{subscription},
+		},
+		{
+			// escaped references and variables the container already sets are left alone
+			targetEnv: []corev1.EnvVar{{Name: "LITERAL", Value: "$$(CLUSTER_NAME)"}, {Name: "REGION", Value: "ukwest"}},
+			sourceEnv: []EnvVar{cluster, region},
+			updated:   []corev1.EnvVar{{Name: "LITERAL", Value: "$$(CLUSTER_NAME)"}, {Name: "REGION", Value: "ukwest"}},
+			remaining: []EnvVar{region, cluster},
+		},
+	}
+
+	for _, e := range envs {
+		updated, patch, remaining := insertEnv(e.targetEnv, e.sourceEnv, "/spec/containers/0/env")
+		if !cmp.Equal(patch, e.patch) {
+			t.Errorf("insertEnv patch was incorrect, for %v, got: %v, want: %v.", e.targetEnv, patch, e.patch)
+		}
+		if !cmp.Equal(updated, e.updated) {
+			t.Errorf("insertEnv updated was incorrect, for %v, got: %v, want: %v.", e.targetEnv, updated, e.updated)
+		}
+		if !cmp.Equal(remaining, e.remaining) {
+			t.Errorf("insertEnv remaining was incorrect, for %v, got: %v, want: %v.", e.targetEnv, remaining, e.remaining)
+		}
+	}
+}
+
+func TestReferencesEnv(t *testing.T) {
+	refs := []struct {
+		value      string
+		references bool
+	}{
+		{"$(CLUSTER_NAME)", true},
+		{"db.$(CLUSTER_NAME).internal", true},
+		{"$$(CLUSTER_NAME)", false},
+		{"$$$(CLUSTER_NAME)", true},
+		{"$$(CLUSTER_NAME) $(CLUSTER_NAME)", true},
+		{"$(CLUSTER_NAME_OLD)", false},
+		{"CLUSTER_NAME", false},
+	}
+
+	for _, r := range refs {
+		references := referencesEnv(r.value, "CLUSTER_NAME")
+		if references != r.references {
+			t.Errorf("referencesEnv was incorrect, for %q, got: %t, want: %t.", r.value, references, r.references)
+		}
+	}
+}
+
+func TestDownwardEnv(t *testing.T) {
+	downward := map[string]string{"NODE_NAME": "spec.nodeName", "POD_IP": "status.podIP", "MEMORY_LIMIT": "limits.memory"}
+	want := []EnvVar{
+		{EnvVar: corev1.EnvVar{Name: "MEMORY_LIMIT", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{ContainerName: "app", Resource: "limits.memory"}}}},
+		{EnvVar: corev1.EnvVar{Name: "NODE_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "spec.nodeName"}}}},
+		{EnvVar: corev1.EnvVar{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "status.podIP"}}}},
+	}
+
+	envVars := downwardEnv(downward, "app")
+	if !cmp.Equal(envVars, want) {
+		t.Errorf("downwardEnv was incorrect, got: %v, want: %v.", envVars, want)
+	}
+
+	if err := validateDownward(downward); err != nil {
+		t.Errorf("validateDownward rejected a valid configuration: %v", err)
+	}
+	if err := validateDownward(map[string]string{"NODE_NAME": "nodeName"}); err == nil {
+		t.Errorf("validateDownward should reject references outside the pod fields and container resources")
+	}
+}
+
+func TestRuntimeTuningEnv(t *testing.T) {
+	rules := []RuntimeTuningRule{
+		{Images: []string{"*/golang-*"}, GoMaxProcs: true},
+		{Images: []string{"hmctspublic.azurecr.io/base/java:*"}, JavaMaxRAMPercentage: 75},
+		{Images: []string{"*node*"}, NodeMaxOldSpacePercentage: 75},
+	}
+	limits := corev1.ResourceRequirements{Limits: corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("1500m"),
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+	}}
+	containers := []struct {
+		container corev1.Container
+		target    []corev1.EnvVar
+		env       []EnvVar
+	}{
+		{
+			container: corev1.Container{Image: "hmctspublic.azurecr.io/golang-api:1.0", Resources: limits},
+			env:       []EnvVar{{EnvVar: corev1.EnvVar{Name: "GOMAXPROCS", Value: "2"}}},
+		},
+		{
+			container: corev1.Container{Image: "hmctspublic.azurecr.io/golang-api:1.0", Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")}}},
+			env:       []EnvVar{{EnvVar: corev1.EnvVar{Name: "GOMAXPROCS", Value: "1"}}},
+		},
+		{
+			container: corev1.Container{Image: "hmctspublic.azurecr.io/golang-api:1.0", Resources: limits},
+			target:    []corev1.EnvVar{{Name: "GOMAXPROCS", Value: "4"}},
+			env:       nil,
+		},
+		{
+			container: corev1.Container{Image: "hmctspublic.azurecr.io/base/java:17-distroless", Resources: limits},
+			env:       []EnvVar{{EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:MaxRAMPercentage=75.0"}, Mode: envModeAppend}},
+		},
+		{
+			container: corev1.Container{Image: "hmctspublic.azurecr.io/base/java:17-distroless", Resources: limits},
+			target:    []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-XX:MaxRAMPercentage=50.0"}},
+			env:       nil,
+		},
+		{
+			container: corev1.Container{Image: "node:20-alpine", Resources: limits},
+			env:       []EnvVar{{EnvVar: corev1.EnvVar{Name: "NODE_OPTIONS", Value: "--max-old-space-size=768"}, Mode: envModeAppend}},
+		},
+		{
+			// no memory limit to size against
+			container: corev1.Container{Image: "node:20-alpine"},
+			env:       nil,
+		},
+		{
+			container: corev1.Container{Image: "nginx:latest", Resources: limits},
+			env:       nil,
+		},
+	}
+
+	for _, c := range containers {
+		env := runtimeTuningEnv(rules, c.container, c.target)
+		if !cmp.Equal(env, c.env) {
+			t.Errorf("runtimeTuningEnv was incorrect, for %v, got: %v, want: %v.", c.container.Image, env, c.env)
+		}
+	}
+}
+
+func TestImageMatches(t *testing.T) {
+	images := []struct {
+		image    string
+		patterns []string
+		matched  bool
+	}{
+		{"hmctspublic.azurecr.io/base/java:17", []string{"*/java:*"}, true},
+		{"hmctspublic.azurecr.io/base/java:17", []string{"*java"}, false},
+		{"hmctspublic.azurecr.io/base/java:17", []string{"nginx*", "hmctspublic.azurecr.io/*"}, true},
+		{"hmctspublic.azurecr.io/base/java:17", nil, false},
+		{"docker.io/library/node.js:20", []string{"*/node.js:*"}, true},
+		{"docker.io/library/nodexjs:20", []string{"*/node.js:*"}, false},
+	}
+
+	for _, i := range images {
+		matched := imageMatches(i.image, i.patterns)
+		if matched != i.matched {
+			t.Errorf("imageMatches was incorrect, for %s %v, got: %t, want: %t.", i.image, i.patterns, matched, i.matched)
+		}
+	}
+}
+
+func TestAddVolumes(t *testing.T) {
+	emptyDir := corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+	vols := []struct {
+		target  []corev1.Volume
+		volumes []corev1.Volume
+		patch   []patchOperation
+	}{
+		{
+			target:  nil,
+			volumes: []corev1.Volume{{Name: "a", VolumeSource: emptyDir}, {Name: "b", VolumeSource: emptyDir}},
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{{Name: "a", VolumeSource: emptyDir}}},
+				{Op: "add", Path: "/spec/volumes/-", Value: corev1.Volume{Name: "b", VolumeSource: emptyDir}},
+			},
+		},
+		{
+			target:  []corev1.Volume{{Name: "a"}},
+			volumes: []corev1.Volume{{Name: "a", VolumeSource: emptyDir}, {Name: "b", VolumeSource: emptyDir}},
+			patch:   []patchOperation{{Op: "add", Path: "/spec/volumes/-", Value: corev1.Volume{Name: "b", VolumeSource: emptyDir}}},
+		},
+	}
+	for _, v := range vols {
+		patch := addVolumes(&v.target, v.volumes, "/spec/volumes")
+		if !cmp.Equal(patch, v.patch) {
+			t.Errorf("addVolumes was incorrect, for %v, got: %v, want: %v.", v.target, patch, v.patch)
+		}
+	}
+
+	mounts := []struct {
+		target []corev1.VolumeMount
+		mounts []corev1.VolumeMount
+		patch  []patchOperation
+	}{
+		{
+			target: nil,
+			mounts: []corev1.VolumeMount{{Name: "a", MountPath: "/a"}},
+			patch:  []patchOperation{{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{{Name: "a", MountPath: "/a"}}}},
+		},
+		{
+			target: []corev1.VolumeMount{{Name: "other", MountPath: "/a"}},
+			mounts: []corev1.VolumeMount{{Name: "a", MountPath: "/a"}, {Name: "b", MountPath: "/b"}},
+			patch:  []patchOperation{{Op: "add", Path: "/spec/containers/0/volumeMounts/-", Value: corev1.VolumeMount{Name: "b", MountPath: "/b"}}},
+		},
+	}
+	for _, m := range mounts {
+		patch := addVolumeMounts(&m.target, m.mounts, "/spec/containers/0/volumeMounts")
+		if !cmp.Equal(patch, m.patch) {
+			t.Errorf("addVolumeMounts was incorrect, for %v, got: %v, want: %v.", m.target, patch, m.patch)
+		}
+	}
+
+	initContainers := []struct {
+		target     []corev1.Container
+		containers []corev1.Container
+		patch      []patchOperation
+	}{
+		{
+			target:     []corev1.Container{{Name: "migrate"}},
+			containers: []corev1.Container{{Name: "agent", Image: "agent:1"}},
+			patch:      []patchOperation{{Op: "add", Path: "/spec/initContainers/-", Value: corev1.Container{Name: "agent", Image: "agent:1"}}},
+		},
+		{
+			target:     []corev1.Container{{Name: "agent", Image: "agent:0"}},
+			containers: []corev1.Container{{Name: "agent", Image: "agent:1"}},
+			patch:      nil,
+		},
+	}
+	for _, c := range initContainers {
+		patch := addInitContainers(&c.target, c.containers, "/spec/initContainers")
+		if !cmp.Equal(patch, c.patch) {
+			t.Errorf("addInitContainers was incorrect, for %v, got: %v, want: %v.", c.target, patch, c.patch)
+		}
+	}
+}
+
+func TestCreatePatchVolumes(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a", Annotations: map[string]string{azureSkipContainersAnnotation: "istio-init"}},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "app",
+			InitContainers:     []corev1.Container{{Name: "migrate", Image: "hmctspublic.azurecr.io/migrate:1"}, {Name: "istio-init", Image: "istio:1"}},
+			Containers:         []corev1.Container{{Name: "app", Image: "hmctspublic.azurecr.io/java-app:1"}, {Name: "sidecar", Image: "envoy:1"}},
+		},
+	}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a", Annotations: map[string]string{azureClientIDAnnotation: "client"}}}
+	config := &Config{
+		Env:                   []EnvVar{{EnvVar: corev1.EnvVar{Name: "DB_PASSWORD"}, KeyVaultRef: &KeyVaultRef{Vault: "team-a", Secret: "db-password"}}},
+		Instrumentation:       Instrumentation{Java: &JavaInstrumentation{Image: "agent:1", AgentPath: "/agent.jar", Images: []string{"*java-app*"}}},
+		TrustBundle:           &TrustBundle{ConfigMap: "corporate-ca"},
+		Timezone:              &Timezone{Name: "Europe/London", ConfigMap: "zoneinfo"},
+		AzureWorkloadIdentity: &AzureWorkloadIdentity{TenantID: "tenant"},
+	}
+
+	patchJSON, err := createPatch(pod.DeepCopy(), config, map[string]string{}, nil, sa)
+	if err != nil {
+		t.Fatalf("createPatch failed: %v", err)
+	}
+	patch, err := jsonpatch.DecodePatch(patchJSON)
+	if err != nil {
+		t.Fatalf("createPatch returned an invalid patch: %v", err)
+	}
+	podJSON, _ := json.Marshal(pod)
+	patchedJSON, err := patch.Apply(podJSON)
+	if err != nil {
+		t.Fatalf("Applying the patch failed: %v", err)
+	}
+	var patched corev1.Pod
+	if err := json.Unmarshal(patchedJSON, &patched); err != nil {
+		t.Fatal(err)
+	}
+
+	var volumes []string
+	for _, v := range patched.Spec.Volumes {
+		volumes = append(volumes, v.Name)
+	}
+	wantVolumes := []string{"keyvault-team-a", javaAgentName, trustBundleVolumeName, timezoneVolumeName, azureTokenVolumeName}
+	if !cmp.Equal(volumes, wantVolumes) {
+		t.Errorf("createPatch volumes were incorrect, got: %v, want: %v.", volumes, wantVolumes)
+	}
+	wantMounts := map[string][]string{
+		"app":                   {"keyvault-team-a", javaAgentName, trustBundleVolumeName, timezoneVolumeName, azureTokenVolumeName},
+		"sidecar":               {"keyvault-team-a", trustBundleVolumeName, timezoneVolumeName, azureTokenVolumeName},
+		"migrate/init":          {azureTokenVolumeName},
+		javaAgentName + "/init": {javaAgentName},
+	}
+	containers := append([]corev1.Container{}, patched.Spec.Containers...)
+	for _, c := range patched.Spec.InitContainers {
+		c.Name += "/init"
+		containers = append(containers, c)
+	}
+	for _, c := range containers {
+		var mounts []string
+		for _, m := range c.VolumeMounts {
+			mounts = append(mounts, m.Name)
+		}
+		if !cmp.Equal(mounts, wantMounts[c.Name]) {
+			t.Errorf("createPatch volume mounts were incorrect, for %s, got: %v, want: %v.", c.Name, mounts, wantMounts[c.Name])
+		}
+	}
+	for _, c := range patched.Spec.InitContainers {
+		hasClientID := envIndex(c.Env, "AZURE_CLIENT_ID") >= 0
+		if hasClientID != (c.Name == "migrate") {
+			t.Errorf("createPatch workload identity env was incorrect, for init container %s, got AZURE_CLIENT_ID: %t.", c.Name, hasClientID)
+		}
+	}
+}
+
+func TestAddJavaInstrumentation(t *testing.T) {
+	java := &JavaInstrumentation{
+		Image:     "agent:3.5.1",
+		AgentPath: "/agent/applicationinsights-agent.jar",
+		Images:    []string{"*/java:*"},
+	}
+	mount := corev1.VolumeMount{Name: javaAgentName, MountPath: defaultJavaAgentMountPath}
+	allowPrivilegeEscalation, runAsNonRoot := false, true
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "nginx", Image: "nginx:latest"},
+		{Name: "app", Image: "hmctspublic.azurecr.io/base/java:17", VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/config"}}},
+	}}}
+	want := []patchOperation{
+		{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{{Name: javaAgentName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}},
+		{Op: "add", Path: "/spec/initContainers", Value: []corev1.Container{{
+			Name:    javaAgentName,
+			Image:   "agent:3.5.1",
+			Command: []string{"cp", "/agent/applicationinsights-agent.jar", defaultJavaAgentMountPath + "/agent.jar"},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m"), corev1.ResourceMemory: resource.MustParse("32Mi")},
+				Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+			},
+			VolumeMounts: []corev1.VolumeMount{mount},
+			SecurityContext: &corev1.SecurityContext{
+				AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+				Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				RunAsNonRoot:             &runAsNonRoot,
+				SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+			},
+		}}},
+		{Op: "add", Path: "/spec/containers/1/volumeMounts/-", Value: mount},
+	}
+
+	patch := addJavaInstrumentation(pod, java)
+	if !cmp.Equal(patch, want) {
+		t.Errorf("addJavaInstrumentation was incorrect, got: %v, want: %v.", patch, want)
+	}
+
+	if patch := addJavaInstrumentation(&corev1.Pod{Spec: corev1.PodSpec{Containers: pod.Spec.Containers[:1]}}, java); patch != nil {
+		t.Errorf("addJavaInstrumentation should not change pods without instrumented containers, got: %v.", patch)
+	}
+
+	sized := *java
+	sized.Resources = &corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")}}
+	patch = addJavaInstrumentation(&corev1.Pod{Spec: corev1.PodSpec{Containers: pod.Spec.Containers}}, &sized)
+	if resources := patch[1].Value.([]corev1.Container)[0].Resources; !cmp.Equal(resources, *sized.Resources) {
+		t.Errorf("addJavaInstrumentation was incorrect, for configured resources got: %v, want: %v.", resources, *sized.Resources)
+	}
+
+	env := javaAgentEnv(java, pod.Spec.Containers[1])
+	wantEnv := []EnvVar{{EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-javaagent:" + defaultJavaAgentMountPath + "/agent.jar"}, Mode: envModeAppend}}
+	if !cmp.Equal(env, wantEnv) {
+		t.Errorf("javaAgentEnv was incorrect, got: %v, want: %v.", env, wantEnv)
+	}
+	if env := javaAgentEnv(java, pod.Spec.Containers[0]); env != nil {
+		t.Errorf("javaAgentEnv should skip containers that are not instrumented, got: %v.", env)
+	}
+}
+
+func TestOtelEnv(t *testing.T) {
+	otel := &OpenTelemetry{ClusterName: "aks-test-01", ResourceAttributes: map[string]string{"deployment.environment": "test"}}
+	controller := true
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "rpe",
+		Labels:          map[string]string{"pod-template-hash": "5d8f7c9b6"},
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-5d8f7c9b6", Controller: &controller}},
+	}}
+	container := corev1.Container{Name: "app"}
+	podName := EnvVar{EnvVar: corev1.EnvVar{Name: otelPodNameEnv, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.name"}}}, Position: envPositionFirst}
+	nodeName := EnvVar{EnvVar: corev1.EnvVar{Name: otelNodeNameEnv, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "spec.nodeName"}}}, Position: envPositionFirst}
+	attributes := "k8s.namespace.name=rpe,k8s.pod.name=$(OTEL_K8S_POD_NAME),k8s.container.name=app,k8s.node.name=$(OTEL_K8S_NODE_NAME),k8s.cluster.name=aks-test-01,deployment.environment=test"
+	envs := []struct {
+		target []corev1.EnvVar
+		env    []EnvVar
+	}{
+		{
+			target: nil,
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "OTEL_SERVICE_NAME", Value: "web"}},
+				podName,
+				nodeName,
+				{EnvVar: corev1.EnvVar{Name: "OTEL_RESOURCE_ATTRIBUTES", Value: attributes}},
+			},
+		},
+		{
+			target: []corev1.EnvVar{{Name: "OTEL_SERVICE_NAME", Value: "custom"}, {Name: "OTEL_RESOURCE_ATTRIBUTES", Value: "service.version=1.2,k8s.cluster.name=own"}},
+			env: []EnvVar{
+				podName,
+				nodeName,
+				{EnvVar: corev1.EnvVar{Name: "OTEL_RESOURCE_ATTRIBUTES", Value: "service.version=1.2,k8s.cluster.name=own,k8s.namespace.name=rpe,k8s.pod.name=$(OTEL_K8S_POD_NAME),k8s.container.name=app,k8s.node.name=$(OTEL_K8S_NODE_NAME),deployment.environment=test"}},
+			},
+		},
+		{
+			target: []corev1.EnvVar{{Name: "OTEL_SERVICE_NAME", Value: "custom"}, {Name: "OTEL_RESOURCE_ATTRIBUTES", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{Key: "attributes"}}}},
+			env:    nil,
+		},
+	}
+
+	for _, e := range envs {
+		env := otelEnv(otel, pod, container, e.target)
+		if !cmp.Equal(env, e.env) {
+			t.Errorf("otelEnv was incorrect, for %v, got: %v, want: %v.", e.target, env, e.env)
+		}
+	}
+}
+
+func TestOtelServiceName(t *testing.T) {
+	controller := true
+	names := []struct {
+		otel *OpenTelemetry
+		pod  *corev1.Pod
+		name string
+	}{
+		{&OpenTelemetry{}, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "legacy", "app.kubernetes.io/name": "web"}}}, "web"},
+		{&OpenTelemetry{}, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "legacy"}}}, "legacy"},
+		{&OpenTelemetry{ServiceNameLabels: []string{"service"}}, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "legacy", "service": "api"}}}, "api"},
+		{&OpenTelemetry{}, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "Job", Name: "backup-28123", Controller: &controller}}}}, "backup-28123"},
+		{&OpenTelemetry{}, &corev1.Pod{}, ""},
+	}
+
+	for _, n := range names {
+		name := otelServiceName(n.otel, n.pod)
+		if name != n.name {
+			t.Errorf("otelServiceName was incorrect, for %v, got: %q, want: %q.", n.pod.ObjectMeta, name, n.name)
+		}
+	}
+}
+
+func TestTrustBundleEnv(t *testing.T) {
+	tb := &TrustBundle{ConfigMap: "corporate-ca", JavaTrustStoreKey: "truststore.p12"}
+	bundle := defaultTrustBundleMountPath + "/ca.crt"
+	javaOpts := EnvVar{
+		EnvVar: corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-Djavax.net.ssl.trustStore=" + defaultTrustBundleMountPath + "/truststore.p12 -Djavax.net.ssl.trustStoreType=PKCS12"},
+		Mode:   envModeAppend,
+	}
+	envs := []struct {
+		tb     *TrustBundle
+		target []corev1.EnvVar
+		env    []EnvVar
+	}{
+		{
+			tb: tb,
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "SSL_CERT_FILE", Value: bundle}},
+				{EnvVar: corev1.EnvVar{Name: "NODE_EXTRA_CA_CERTS", Value: bundle}},
+				{EnvVar: corev1.EnvVar{Name: "REQUESTS_CA_BUNDLE", Value: bundle}},
+				javaOpts,
+			},
+		},
+		{
+			tb:     tb,
+			target: []corev1.EnvVar{{Name: "SSL_CERT_FILE", Value: "/own.pem"}, {Name: "JAVA_TOOL_OPTIONS", Value: "-Djavax.net.ssl.trustStore=/own.jks"}},
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "NODE_EXTRA_CA_CERTS", Value: bundle}},
+				{EnvVar: corev1.EnvVar{Name: "REQUESTS_CA_BUNDLE", Value: bundle}},
+			},
+		},
+		{
+			tb: &TrustBundle{Secret: "corporate-ca", Key: "bundle.pem", MountPath: "/certs"},
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "SSL_CERT_FILE", Value: "/certs/bundle.pem"}},
+				{EnvVar: corev1.EnvVar{Name: "NODE_EXTRA_CA_CERTS", Value: "/certs/bundle.pem"}},
+				{EnvVar: corev1.EnvVar{Name: "REQUESTS_CA_BUNDLE", Value: "/certs/bundle.pem"}},
+			},
+		},
+	}
+
+	for _, e := range envs {
+		env := trustBundleEnv(e.tb, e.target)
+		if !cmp.Equal(env, e.env) {
+			t.Errorf("trustBundleEnv was incorrect, for %v, got: %v, want: %v.", e.target, env, e.env)
+		}
+	}
+}
+
+func TestProxyEnv(t *testing.T) {
+	proxy := &Proxy{HTTPProxy: "http://proxy:3128", ClusterCIDRs: []string{"10.0.0.0/16"}, NoProxy: []string{".corp.example"}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a"}}
+	noProxy := "localhost,127.0.0.1,10.0.0.0/16,.svc,.cluster.local,.team-a,.corp.example"
+	envs := []struct {
+		target []corev1.EnvVar
+		env    []EnvVar
+	}{
+		{
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://proxy:3128"}},
+				{EnvVar: corev1.EnvVar{Name: "http_proxy", Value: "http://proxy:3128"}},
+				{EnvVar: corev1.EnvVar{Name: "NO_PROXY", Value: noProxy}},
+				{EnvVar: corev1.EnvVar{Name: "no_proxy", Value: noProxy}},
+			},
+		},
+		{
+			target: []corev1.EnvVar{{Name: "http_proxy", Value: "http://own:8080"}, {Name: "no_proxy", Value: "example.com,localhost"}},
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "HTTP_PROXY", Value: "http://own:8080"}},
+				{EnvVar: corev1.EnvVar{Name: "NO_PROXY", Value: "example.com," + noProxy}},
+				{EnvVar: corev1.EnvVar{Name: "no_proxy", Value: "example.com," + noProxy}},
+			},
+		},
+		{
+			target: []corev1.EnvVar{
+				{Name: "HTTP_PROXY", Value: "http://proxy:3128"},
+				{Name: "http_proxy", Value: "http://proxy:3128"},
+				{Name: "NO_PROXY", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{Key: "no_proxy"}}},
+			},
+		},
+	}
+
+	for _, e := range envs {
+		env := proxyEnv(proxy, pod, e.target)
+		if !cmp.Equal(env, e.env) {
+			t.Errorf("proxyEnv was incorrect, for %v, got: %v, want: %v.", e.target, env, e.env)
+		}
+	}
+}
+
+func TestAddTimezone(t *testing.T) {
+	// addTimezone records what it adds on the pod, so each case starts from a fresh one
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}, {Name: "sidecar", VolumeMounts: []corev1.VolumeMount{{Name: "tz", MountPath: localtimePath}}}},
+		}}
+	}
+	fileType := corev1.HostPathFile
+	tests := []struct {
+		tz    *Timezone
+		patch []patchOperation
+	}{
+		{&Timezone{Name: "Europe/London"}, nil},
+		{
+			&Timezone{Name: "Europe/London", ConfigMap: "zoneinfo"},
+			[]patchOperation{
+				{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{{Name: timezoneVolumeName, VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "zoneinfo"},
+					Items:                []corev1.KeyToPath{{Key: "Europe_London", Path: "localtime"}},
+				}}}}},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{{Name: timezoneVolumeName, MountPath: localtimePath, SubPath: "localtime", ReadOnly: true}}},
+			},
+		},
+		{
+			&Timezone{Name: "Europe/London", HostPath: "/usr/share/zoneinfo"},
+			[]patchOperation{
+				{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{{Name: timezoneVolumeName, VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
+					Path: "/usr/share/zoneinfo/Europe/London",
+					Type: &fileType,
+				}}}}},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{{Name: timezoneVolumeName, MountPath: localtimePath, ReadOnly: true}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		patch := addTimezone(newPod(), tt.tz)
+		if !cmp.Equal(patch, tt.patch) {
+			t.Errorf("addTimezone was incorrect, for %v, got: %v, want: %v.", tt.tz, patch, tt.patch)
+		}
+	}
+	if env := timezoneEnv(&Timezone{Name: "Europe/London"}, []corev1.EnvVar{{Name: "TZ", Value: "UTC"}}); env != nil {
+		t.Errorf("timezoneEnv was incorrect, got: %v, want: nil.", env)
+	}
+}
+
+func TestWaitForCacheSync(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}), 0)
+	factory.Core().V1().Namespaces().Informer()
+	factory.Start(stopCh)
+	if synced := waitForCacheSync(factory.WaitForCacheSync, stopCh, "lookups will miss"); !synced {
+		t.Errorf("waitForCacheSync was incorrect, got: %v, want: %v.", synced, true)
+	}
+
+	// a cache that never syncs gives up when the webhook stops, rather than waiting for informerSyncTimeout
+	stoppedCh := make(chan struct{})
+	close(stoppedCh)
+	never := func(stopCh <-chan struct{}) map[string]bool {
+		<-stopCh
+		return map[string]bool{"envinjectionpolicies": false}
+	}
+	if synced := waitForCacheSync(never, stoppedCh, "policies will be missing"); synced {
+		t.Errorf("waitForCacheSync was incorrect, got: %v, want: %v.", synced, false)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	whsvr := &WebhookServer{}
+	for _, ready := range []bool{false, true} {
+		whsvr.ready.Store(ready)
+		w := httptest.NewRecorder()
+		whsvr.readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		want := http.StatusServiceUnavailable
+		if ready {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("readyz was incorrect, for ready %v got: %v, want: %v.", ready, w.Code, want)
+		}
+	}
+}
+
+func TestLookupServiceAccount(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        "workload",
+		Namespace:   "team-a",
+		Annotations: map[string]string{azureClientIDAnnotation: "00000000-0000-0000-0000-000000000001"},
+	}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	whsvr := &WebhookServer{}
+	whsvr.startInformers(client, stopCh)()
+
+	tests := []struct {
+		pod      *corev1.Pod
+		clientID string
+	}{
+		{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a"}, Spec: corev1.PodSpec{ServiceAccountName: "workload"}}, "00000000-0000-0000-0000-000000000001"},
+		{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a"}}, ""},
+		{&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-b"}, Spec: corev1.PodSpec{ServiceAccountName: "workload"}}, ""},
+	}
+
+	for _, tt := range tests {
+		sa := lookupServiceAccount(whsvr.serviceAccounts, tt.pod)
+		if clientID := azureWorkloadIdentityClientID(&AzureWorkloadIdentity{}, sa); clientID != tt.clientID {
+			t.Errorf("lookupServiceAccount was incorrect, for %s/%s, got client ID: %q, want: %q.", tt.pod.Namespace, tt.pod.Spec.ServiceAccountName, clientID, tt.clientID)
+		}
+	}
+	if sa := lookupServiceAccount(nil, tests[0].pod); sa != nil {
+		t.Errorf("lookupServiceAccount was incorrect without a lister, got: %v, want: nil.", sa)
+	}
+}
+
+func TestAzureWorkloadIdentityEnv(t *testing.T) {
+	wi := &AzureWorkloadIdentity{TenantID: "default-tenant"}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{azureClientIDAnnotation: "client"}}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{azureSkipContainersAnnotation: "istio-proxy; linkerd-proxy"}}}
+	tokenFile := azureTokenMountPath + "/" + azureTokenVolumeName
+	envs := []struct {
+		sa        *corev1.ServiceAccount
+		container corev1.Container
+		env       []EnvVar
+	}{
+		{
+			sa:        sa,
+			container: corev1.Container{Name: "app"},
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "AZURE_CLIENT_ID", Value: "client"}},
+				{EnvVar: corev1.EnvVar{Name: "AZURE_TENANT_ID", Value: "default-tenant"}},
+				{EnvVar: corev1.EnvVar{Name: "AZURE_FEDERATED_TOKEN_FILE", Value: tokenFile}},
+				{EnvVar: corev1.EnvVar{Name: "AZURE_AUTHORITY_HOST", Value: defaultAzureAuthorityHost}},
+			},
+		},
+		{
+			sa:        &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{azureClientIDAnnotation: "client", azureTenantIDAnnotation: "own-tenant"}}},
+			container: corev1.Container{Name: "app", Env: []corev1.EnvVar{{Name: "AZURE_AUTHORITY_HOST", Value: "https://login.microsoftonline.us/"}}},
+			env: []EnvVar{
+				{EnvVar: corev1.EnvVar{Name: "AZURE_CLIENT_ID", Value: "client"}},
+				{EnvVar: corev1.EnvVar{Name: "AZURE_TENANT_ID", Value: "own-tenant"}},
+				{EnvVar: corev1.EnvVar{Name: "AZURE_FEDERATED_TOKEN_FILE", Value: tokenFile}},
+			},
+		},
+		{sa: sa, container: corev1.Container{Name: "linkerd-proxy"}},
+		{sa: &corev1.ServiceAccount{}, container: corev1.Container{Name: "app"}},
+		{sa: nil, container: corev1.Container{Name: "app"}},
+	}
+
+	for _, e := range envs {
+		env := azureWorkloadIdentityEnv(wi, e.sa, pod, e.container, e.container.Env)
+		if !cmp.Equal(env, e.env) {
+			t.Errorf("azureWorkloadIdentityEnv was incorrect, for %v, got: %v, want: %v.", e.container.Name, env, e.env)
+		}
+	}
+}
+
+func TestAddAzureWorkloadIdentity(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{azureSkipContainersAnnotation: "istio-proxy"},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "istio-proxy"}, {Name: "migrate"}},
+			Containers:     []corev1.Container{{Name: "app"}, {Name: "istio-proxy"}},
+		},
+	}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		azureClientIDAnnotation:        "client",
+		azureTokenExpirationAnnotation: "86400",
+	}}}
+	expiration := int64(86400)
+	want := []patchOperation{
+		{Op: "add", Path: "/metadata/labels/azure.workload.identity~1use", Value: "true"},
+		{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{{Name: azureTokenVolumeName, VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+			Sources: []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+				Audience:          azureTokenAudience,
+				ExpirationSeconds: &expiration,
+				Path:              azureTokenVolumeName,
+			}}},
+		}}}}},
+		{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{{Name: azureTokenVolumeName, MountPath: azureTokenMountPath, ReadOnly: true}}},
+		{Op: "add", Path: "/spec/initContainers/1/volumeMounts", Value: []corev1.VolumeMount{{Name: azureTokenVolumeName, MountPath: azureTokenMountPath, ReadOnly: true}}},
+	}
+
+	patch := addAzureWorkloadIdentity(pod, &AzureWorkloadIdentity{}, sa)
+	if !cmp.Equal(patch, want) {
+		t.Errorf("addAzureWorkloadIdentity was incorrect, got: %v, want: %v.", patch, want)
+	}
+	if patch := addAzureWorkloadIdentity(pod, &AzureWorkloadIdentity{}, &corev1.ServiceAccount{}); patch != nil {
+		t.Errorf("addAzureWorkloadIdentity was incorrect without a client ID, got: %v, want: nil.", patch)
+	}
+}
+
+func TestResolveKeyVaultRefs(t *testing.T) {
+	env := []EnvVar{
+		{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+		{EnvVar: corev1.EnvVar{Name: "DATABASE_PASSWORD"}, KeyVaultRef: &KeyVaultRef{Vault: "Team-A-KV", Secret: "database-password"}},
+		{EnvVar: corev1.EnvVar{Name: "API_KEY"}, KeyVaultRef: &KeyVaultRef{Vault: "team-a-kv", Secret: "api-key"}, Position: envPositionFirst},
+	}
+	secretRef := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "keyvault-team-a-kv"}, Key: key}}
+	}
+	want := []EnvVar{
+		{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+		{EnvVar: corev1.EnvVar{Name: "DATABASE_PASSWORD", ValueFrom: secretRef("database-password")}},
+		{EnvVar: corev1.EnvVar{Name: "API_KEY", ValueFrom: secretRef("api-key")}, Position: envPositionFirst},
+	}
+
+	resolved, vaults := resolveKeyVaultRefs(env)
+	if !cmp.Equal(resolved, want) {
+		t.Errorf("resolveKeyVaultRefs was incorrect, got: %v, want: %v.", resolved, want)
+	}
+	if !cmp.Equal(vaults, []string{"keyvault-team-a-kv"}) {
+		t.Errorf("resolveKeyVaultRefs was incorrect, got vaults: %v, want: [keyvault-team-a-kv].", vaults)
+	}
+	if env[1].KeyVaultRef == nil {
+		t.Errorf("resolveKeyVaultRefs modified the configuration")
+	}
+}
+
+func TestAddKeyVaultVolumes(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Volumes:    []corev1.Volume{{Name: "keyvault-shared"}},
+		Containers: []corev1.Container{{Name: "app"}},
+	}}
+	readOnly := true
+	want := []patchOperation{
+		{Op: "add", Path: "/spec/volumes/-", Value: corev1.Volume{Name: "keyvault-team-a-kv", VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{
+			Driver:           secretsStoreDriver,
+			ReadOnly:         &readOnly,
+			VolumeAttributes: map[string]string{secretProviderClassAttrKey: "keyvault-team-a-kv"},
+		}}}},
+		{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{{Name: "keyvault-shared", MountPath: "/mnt/secrets-store/shared", ReadOnly: true}}},
+		{Op: "add", Path: "/spec/containers/0/volumeMounts/-", Value: corev1.VolumeMount{Name: "keyvault-team-a-kv", MountPath: "/mnt/secrets-store/team-a-kv", ReadOnly: true}},
+	}
+
+	patch := addKeyVaultVolumes(pod, []string{"keyvault-shared", "keyvault-team-a-kv"})
+	if !cmp.Equal(patch, want) {
+		t.Errorf("addKeyVaultVolumes was incorrect, got: %v, want: %v.", patch, want)
+	}
+}
+
+func TestAddTrustBundle(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Volumes:    []corev1.Volume{{Name: "config"}},
+		Containers: []corev1.Container{{Name: "app"}, {Name: "sidecar", VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/config"}}}},
+	}}
+	mount := corev1.VolumeMount{Name: trustBundleVolumeName, MountPath: defaultTrustBundleMountPath, ReadOnly: true}
+	want := []patchOperation{
+		{Op: "add", Path: "/spec/volumes/-", Value: corev1.Volume{Name: trustBundleVolumeName, VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "corporate-ca"}}}},
+		{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{mount}},
+		{Op: "add", Path: "/spec/containers/1/volumeMounts/-", Value: mount},
+	}
+
+	patch := addTrustBundle(pod, &TrustBundle{Secret: "corporate-ca"})
+	if !cmp.Equal(patch, want) {
+		t.Errorf("addTrustBundle was incorrect, got: %v, want: %v.", patch, want)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "envconfig.yaml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	whsvr := &WebhookServer{}
+
+	writeConfig("env:\n  - name: CLUSTER_NAME\n    value: aks-test-01\n")
+	if err := whsvr.reloadConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	first := whsvr.config()
+
+	writeConfig("env:\n  - name: CLUSTER_NAME\n    valu: aks-test-02\n")
+	if err := whsvr.reloadConfig(configFile); err == nil {
+		t.Errorf("reloadConfig was incorrect, got no error for an invalid configuration")
+	}
+	if err := whsvr.reloadConfig(configFile); err != nil {
+		t.Errorf("reloadConfig was incorrect, reported the same invalid configuration twice: %v", err)
+	}
+	if whsvr.config() != first {
+		t.Errorf("reloadConfig was incorrect, replaced the configuration with an invalid one")
+	}
+
+	writeConfig("env:\n  - name: CLUSTER_NAME\n    value: aks-test-02\n")
+	if err := whsvr.reloadConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	want := []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-02"}}}
+	if got := whsvr.config().Env; !cmp.Equal(got, want) {
+		t.Errorf("reloadConfig was incorrect, got: %v, want: %v.", got, want)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	// lay the directory out the way the kubelet mounts a ConfigMap, with the file behind the ..data symlink
+	dir := t.TempDir()
+	writeVersion := func(version, value string) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		content := "env:\n  - name: CLUSTER_NAME\n    value: " + value + "\n"
+		if err := os.WriteFile(filepath.Join(dir, version, "envconfig.yaml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..v1", "aks-test-01")
+	configFile := filepath.Join(dir, "envconfig.yaml")
+	if err := os.Symlink(filepath.Join("..data", "envconfig.yaml"), configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	whsvr := &WebhookServer{}
+	if err := whsvr.reloadConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := whsvr.watchConfig(configFile, stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	writeVersion("..v2", "aks-test-02")
+	deadline := time.Now().Add(5 * time.Second)
+	for whsvr.config().Env[0].Value != "aks-test-02" {
+		if time.Now().After(deadline) {
+			t.Fatalf("watchConfig was incorrect, the configuration was not reloaded after the ..data symlink swap")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	automount := false
+	base := &Config{
+		Env:        []EnvVar{{EnvVar: corev1.EnvVar{Name: "A", Value: "1"}}, {EnvVar: corev1.EnvVar{Name: "B", Value: "1"}}},
+		RemoveEnv:  []string{"OLD_*"},
+		DnsOptions: []corev1.PodDNSConfigOption{{Name: "use-vc"}},
+		Tolerations: []Toleration{
+			{Toleration: corev1.Toleration{Key: "spot", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}},
+		},
+		Defaults: map[string]interface{}{"spec.securityContext.runAsNonRoot": true},
+	}
+	overlay := &Config{
+		Env:                          []EnvVar{{EnvVar: corev1.EnvVar{Name: "A", Value: "2"}}, {EnvVar: corev1.EnvVar{Name: "C", Value: "1"}}},
+		RemoveEnv:                    []string{"OLD_*", "LEGACY"},
+		Tolerations:                  []Toleration{{Toleration: corev1.Toleration{Key: "spot", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule}}},
+		AutomountServiceAccountToken: &automount,
+		Defaults:                     map[string]interface{}{"spec.setHostnameAsFQDN": true},
+	}
+	want := &Config{
+		Env: []EnvVar{
+			{EnvVar: corev1.EnvVar{Name: "A", Value: "2"}},
+			{EnvVar: corev1.EnvVar{Name: "B", Value: "1"}},
+			{EnvVar: corev1.EnvVar{Name: "C", Value: "1"}},
+		},
+		RemoveEnv:                    []string{"OLD_*", "LEGACY"},
+		DnsOptions:                   []corev1.PodDNSConfigOption{{Name: "use-vc"}},
+		Tolerations:                  []Toleration{{Toleration: corev1.Toleration{Key: "spot", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule}}},
+		AutomountServiceAccountToken: &automount,
+		Defaults:                     map[string]interface{}{"spec.securityContext.runAsNonRoot": true, "spec.setHostnameAsFQDN": true},
+	}
+
+	merged := mergeConfig(base, overlay)
+	if !cmp.Equal(merged, want) {
+		t.Errorf("mergeConfig was incorrect, got: %v, want: %v.", merged, want)
+	}
+	if base.Env[0].Value != "1" || len(base.Defaults) != 1 {
+		t.Errorf("mergeConfig was incorrect, modified the base configuration: %v", base)
+	}
+}
+
+func TestPolicyController(t *testing.T) {
+	policy := func(gvr schema.GroupVersionResource, kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		obj.SetAPIVersion(gvr.GroupVersion().String())
+		obj.SetKind(kind)
+		obj.SetNamespace(namespace)
+		obj.SetName(name)
+		obj.SetGeneration(1)
+		return obj
+	}
+	env := func(name, value string) []interface{} {
+		return []interface{}{map[string]interface{}{"name": name, "value": value}}
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			envInjectionPolicyGVR:           "EnvInjectionPolicyList",
+			namespacedEnvInjectionPolicyGVR: "NamespacedEnvInjectionPolicyList",
+		},
+		policy(envInjectionPolicyGVR, "EnvInjectionPolicy", "", "override", map[string]interface{}{"priority": int64(10), "env": env("A", "2")}),
+		policy(envInjectionPolicyGVR, "EnvInjectionPolicy", "", "base", map[string]interface{}{"env": env("A", "1")}),
+		policy(envInjectionPolicyGVR, "EnvInjectionPolicy", "", "invalid", map[string]interface{}{"env": []interface{}{map[string]interface{}{"name": "A", "mode": "merge"}}}),
+		policy(namespacedEnvInjectionPolicyGVR, "NamespacedEnvInjectionPolicy", "team-a", "team", map[string]interface{}{
+			"apiVersion": configAPIVersionV1alpha1, "kind": configKind, "env": env("B", "1"),
+		}),
+	)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	pc := newPolicyController(client)
+	pc.start(stopCh)()
+
+	fileConfig := &Config{Env: []EnvVar{{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}}}}
+	tests := []struct {
+		namespace string
+		env       []EnvVar
+	}{
+		{"team-a", []EnvVar{
+			{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+			{EnvVar: corev1.EnvVar{Name: "A", Value: "2"}},
+			{EnvVar: corev1.EnvVar{Name: "B", Value: "1"}},
+		}},
+		{"team-b", []EnvVar{
+			{EnvVar: corev1.EnvVar{Name: "CLUSTER_NAME", Value: "aks-test-01"}},
+			{EnvVar: corev1.EnvVar{Name: "A", Value: "2"}},
+		}},
+	}
+	for _, tt := range tests {
+		if env := pc.configFor(fileConfig, tt.namespace).Env; !cmp.Equal(env, tt.env) {
+			t.Errorf("configFor was incorrect, for %s, got: %v, want: %v.", tt.namespace, env, tt.env)
+		}
+	}
+
+	invalid, err := client.Resource(envInjectionPolicyGVR).Get(context.Background(), "invalid", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions, _, _ := unstructured.NestedSlice(invalid.Object, "status", "conditions")
+	if len(conditions) != 1 || conditions[0].(map[string]interface{})["reason"] != policyReasonInvalid {
+		t.Errorf("policyController was incorrect, got status conditions: %v, want a %s condition.", conditions, policyReasonInvalid)
+	}
+
+	if err := client.Resource(envInjectionPolicyGVR).Delete(context.Background(), "override", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pc.configFor(fileConfig, "team-b").Env[1].Value != "1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("policyController was incorrect, the deleted policy is still applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTeamOverrides(t *testing.T) {
+	override := func(namespace, name string, labelled bool, data string) *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string]string{teamOverrideKey: data},
+		}
+		if labelled {
+			cm.Labels = map[string]string{teamOverrideLabel: "true"}
+		}
+		return cm
+	}
+	client := fake.NewSimpleClientset(
+		override("team-a", "b-env", true, "apiVersion: env-injector.hmcts.net/v1alpha1\nkind: EnvInjectorConfig\nenv:\n  - name: A\n    value: \"3\"\n"),
+		override("team-a", "a-env", true, "env:\n  - name: A\n    value: \"2\"\n  - name: B\n    value: \"1\"\ntolerations:\n  - key: dedicated\n    operator: Exists\n"),
+		override("team-a", "invalid", true, "env:\n  - name: C\n    mode: merge\n"),
+		override("team-a", "unlabelled", false, "env:\n  - name: D\n    value: \"1\"\n"),
+		override("team-b", "team-b", true, "env:\n  - name: E\n    value: \"1\"\n"),
+	)
+	fileConfig := &Config{
+		Env:              []EnvVar{{EnvVar: corev1.EnvVar{Name: "A", Value: "1"}}},
+		AllowedOverrides: []string{"env"},
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	oc := newOverrideController(client, func() []string { return fileConfig.AllowedOverrides })
+	recorder := record.NewFakeRecorder(10)
+	oc.recorder = recorder
+	oc.start(client, stopCh)()
+
+	want := []EnvVar{
+		{EnvVar: corev1.EnvVar{Name: "A", Value: "3"}},
+		{EnvVar: corev1.EnvVar{Name: "B", Value: "1"}},
+	}
+	cfg := oc.configFor(fileConfig, "team-a")
+	if !cmp.Equal(cfg.Env, want) || len(cfg.Tolerations) != 0 {
+		t.Errorf("configFor was incorrect, got env: %v, tolerations: %v, want env: %v and no tolerations.", cfg.Env, cfg.Tolerations, want)
+	}
+	if cfg := oc.configFor(fileConfig, "team-c"); cfg != fileConfig {
+		t.Errorf("configFor was incorrect, got: %v for a namespace without overrides, want: %v.", cfg, fileConfig)
+	}
+	if cfg := oc.configFor(&Config{Env: fileConfig.Env}, "team-b"); len(cfg.Env) != 1 {
+		t.Errorf("configFor was incorrect, got env: %v when no overrides are allowed, want: %v.", cfg.Env, fileConfig.Env)
+	}
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, strings.SplitN(<-recorder.Events, " ", 3)[1])
+	}
+	sort.Strings(events)
+	if wantEvents := []string{teamOverrideReasonIgnored, teamOverrideReasonInvalid}; !cmp.Equal(events, wantEvents) {
+		t.Errorf("overrideController was incorrect, got events: %v, want: %v.", events, wantEvents)
+	}
+
+	_, err := decodeTeamOverride(override("team-a", "layered", true, "base:\n  env:\n    - name: A\n      value: \"1\"\n"))
+	if want := "envconfig.yaml:1: base: can only be used in the configuration file"; fmt.Sprint(err) != want {
+		t.Errorf("decodeTeamOverride was incorrect, got: %v, want: %s.", err, want)
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	var out strings.Builder
+	if err := runSchema(nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal([]byte(out.String()), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	toleration := schema.Definitions["Toleration"]
+	if toleration == nil || toleration.AdditionalProperties != false {
+		t.Fatalf("configSchema was incorrect, got Toleration: %+v, want a strict object.", toleration)
+	}
+	tests := []struct {
+		name string
+		got  *jsonSchema
+		want *jsonSchema
+	}{
+		{"Toleration.tolerationSeconds", toleration.Properties["tolerationSeconds"], &jsonSchema{Type: []interface{}{"integer", "null"}}},
+		{"Toleration.when", toleration.Properties["when"], &jsonSchema{Type: []interface{}{"string", "number", "boolean"}}},
+		{"EnvVar.valueFrom", schema.Definitions["EnvVar"].Properties["valueFrom"], &jsonSchema{AnyOf: []*jsonSchema{{Ref: "#/definitions/io.k8s.api.core.v1.EnvVarSource"}, {Type: "null"}}}},
+		{"EnvInjectorConfig.apiVersion", schema.Definitions["EnvInjectorConfig"].Properties["apiVersion"], &jsonSchema{Type: "string", Enum: []string{configAPIVersionV1alpha2}}},
+		{"LayeredConfig.overlays", schema.Definitions["LayeredEnvInjectorConfig"].Properties["overlays"], &jsonSchema{Type: "object", AdditionalProperties: map[string]interface{}{
+			"anyOf": []interface{}{map[string]interface{}{"$ref": "#/definitions/Config"}, map[string]interface{}{"type": "null"}},
+		}}},
+	}
+	for _, tt := range tests {
+		if !cmp.Equal(tt.got, tt.want) {
+			t.Errorf("configSchema was incorrect, for %s got: %+v, want: %+v.", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestValuesSchema(t *testing.T) {
+	var out strings.Builder
+	if err := runSchema([]string{"-values"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile("../env-injector-webhook/values.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(committed) {
+		t.Errorf("values.schema.json is out of date, regenerate it with: go run . schema -values > ../env-injector-webhook/values.schema.json")
+	}
+}
+
+func TestPolicyCRDs(t *testing.T) {
+	crds := map[string]string{
+		"EnvInjectionPolicy":           "../env-injector-webhook/crds/envinjectionpolicy.yaml",
+		"NamespacedEnvInjectionPolicy": "../env-injector-webhook/crds/namespacedenvinjectionpolicy.yaml",
+	}
+	for kind, file := range crds {
+		var out strings.Builder
+		if err := runSchema([]string{"-crd", kind}, &out); err != nil {
+			t.Fatal(err)
+		}
+		committed, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != string(committed) {
+			t.Errorf("%s is out of date, regenerate it with: go run . schema -crd %s > %s", file, kind, file)
+		}
+	}
+
+	spec := policySpecSchema()
+	checks := []struct {
+		name string
+		got  *openAPISchema
+		want *openAPISchema
+	}{
+		{"priority", spec.Properties["priority"], &openAPISchema{Description: "Policies are applied in order of priority, then name.", Type: "integer", Format: "int64"}},
+		{"allowedOverrides", spec.Properties["allowedOverrides"], nil},
+		{"tolerations.items.tolerationSeconds", spec.Properties["tolerations"].Items.Properties["tolerationSeconds"], &openAPISchema{Type: "integer", Nullable: true}},
+		{"defaults", spec.Properties["defaults"], &openAPISchema{Type: "object", AdditionalProperties: &openAPISchema{PreserveUnknownFields: true}}},
+		{"instrumentation.java.resources.limits", spec.Properties["instrumentation"].Properties["java"].Properties["resources"].Properties["limits"],
+			&openAPISchema{Type: "object", AdditionalProperties: &openAPISchema{AnyOf: []*openAPISchema{{Type: "integer"}, {Type: "string"}}, IntOrString: true}}},
+	}
+	for _, c := range checks {
+		if !cmp.Equal(c.got, c.want) {
+			t.Errorf("policySpecSchema was incorrect, for %s, got: %+v, want: %+v.", c.name, c.got, c.want)
+		}
+	}
+	if spec.PreserveUnknownFields {
+		t.Errorf("policySpecSchema was incorrect, the spec preserves unknown fields.")
+	}
+	if err := runSchema([]string{"-crd", "Policy"}, io.Discard); err == nil {
+		t.Errorf("runSchema should fail for an unknown policy kind")
+	}
+}
+
+func TestLoadSignedConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		t.Helper()
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	writeKey := func(name string, key crypto.PublicKey) crypto.PublicKey {
+		t.Helper()
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadConfigPublicKey(writeFile(name, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loaded
+	}
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := writeKey("ed25519.pub", edPublic)
+	otherPublic, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := writeKey("other.pub", otherPublic)
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := writeKey("cosign.pub", &ecPrivate.PublicKey)
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&rsaPrivate.PublicKey)
+	if _, err := loadConfigPublicKey(writeFile("rsa.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))); err == nil {
+		t.Errorf("loadConfigPublicKey was incorrect, got no error for an RSA key")
+	}
+	edDER, _ := x509.MarshalPKIXPublicKey(edPublic)
+	if parsed, err := parseConfigPublicKey("$"+configPublicKeyEnv, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: edDER})); err != nil || !cmp.Equal(parsed, edKey) {
+		t.Errorf("parseConfigPublicKey was incorrect, got: %v, %v, want: %v.", parsed, err, edKey)
+	}
+	if _, err := parseConfigPublicKey("$"+configPublicKeyEnv, []byte("not a key")); err == nil {
+		t.Errorf("parseConfigPublicKey was incorrect, got no error for a value that is not PEM")
+	}
+
+	data := []byte("env:\n  - name: CLUSTER_NAME\n    value: aks-test-01\n")
+	edSig := ed25519.Sign(edPrivate, data)
+	digest := sha256.Sum256(data)
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecPrivate, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte("env:\n  - name: CLUSTER_NAME\n    value: aks-prod-01\n")
+
+	configs := []struct {
+		name  string
+		data  []byte
+		sig   []byte
+		key   crypto.PublicKey
+		valid bool
+	}{
+		{"ed25519 base64", data, []byte(base64.StdEncoding.EncodeToString(edSig) + "\n"), edKey, true},
+		{"ed25519 raw", data, edSig, edKey, true},
+		{"cosign", data, []byte(base64.StdEncoding.EncodeToString(ecSig)), ecKey, true},
+		{"unsigned", data, nil, edKey, false},
+		{"tampered", tampered, edSig, edKey, false},
+		{"other key", data, edSig, otherKey, false},
+		{"cosign tampered", tampered, []byte(base64.StdEncoding.EncodeToString(ecSig)), ecKey, false},
+	}
+	for _, c := range configs {
+		file := writeFile("envconfig.yaml", c.data)
+		os.Remove(file + configSignatureSuffix)
+		if c.sig != nil {
+			writeFile("envconfig.yaml"+configSignatureSuffix, c.sig)
+		}
+		_, _, err := loadConfig(file, "", c.key)
+		if valid := err == nil; valid != c.valid {
+			t.Errorf("loadConfig was incorrect, for %s got: %v, want valid: %v.", c.name, err, c.valid)
+		}
+	}
+
+	configDir := filepath.Join(dir, "config")
+	if err := os.Mkdir(configDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dns := []byte("dnsOptions:\n  - name: use-vc\n")
+	writeFile("config/00-env.yaml", data)
+	writeFile("config/10-dns.yaml", dns)
+	manifest := configManifest([]string{"00-env.yaml", "10-dns.yaml"}, [][]byte{data, dns})
+	dataSum, dnsSum := sha256.Sum256(data), sha256.Sum256(dns)
+	if want := fmt.Sprintf("%x  00-env.yaml\n%x  10-dns.yaml\n", dataSum, dnsSum); string(manifest) != want {
+		t.Errorf("configManifest was incorrect, got: %q, want: %q.", manifest, want)
+	}
+	writeFile("config/00-env.yaml"+configSignatureSuffix, edSig)
+	if _, _, err := loadConfig(configDir, "", edKey); err == nil {
+		t.Errorf("loadConfig was incorrect, got no error for a directory with a signature per file only")
+	}
+
+	writeFile("config/"+configManifestSignature, ed25519.Sign(edPrivate, manifest))
+	if cfg, _, err := loadConfig(configDir, "", edKey); err != nil || len(cfg.Env) != 1 || len(cfg.DnsOptions) != 1 {
+		t.Errorf("loadConfig was incorrect, got: %v, %v, want the merged configuration.", cfg, err)
+	}
+	dirs := []struct {
+		name   string
+		change func()
+	}{
+		{"removed file", func() { os.Remove(filepath.Join(configDir, "10-dns.yaml")) }},
+		{"added file", func() { writeFile("config/20-env.yaml", data) }},
+		{"changed file", func() { writeFile("config/10-dns.yaml", []byte("dnsOptions:\n  - name: ndots\n")) }},
+		{"older manifest", func() {
+			writeFile("config/"+configManifestSignature, ed25519.Sign(edPrivate, configManifest([]string{"00-env.yaml"}, [][]byte{data})))
+		}},
+	}
+	for _, c := range dirs {
+		c.change()
+		_, _, err = loadConfig(configDir, "", edKey)
+		if want := configDir + ": refusing unverified configuration"; err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("loadConfig was incorrect, for %s got: %v, want: %s.", c.name, err, want)
+		}
+		writeFile("config/10-dns.yaml", dns)
+		os.Remove(filepath.Join(configDir, "20-env.yaml"))
+		writeFile("config/"+configManifestSignature, ed25519.Sign(edPrivate, manifest))
+	}
+}